@@ -1,34 +1,70 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"math/rand"
 	"errors"
 	"strconv"
 	"flag"
+	"time"
+	"slices"
+	"strings"
 )
 
 type Client struct {
 	id string
+
+	// codec nodes are asked to store uploaded files with, empty leaves it to the node
+	storageCompression string
+	// compress uploads and downloads on the wire when the node supports it
+	wireCompression bool
+
+	// encrypt every collection with its own key before uploading
+	encrypt bool
+	keyring *KeyRing
+	// key of the collection being uploaded, moved to the key ring on commit
+	collectionKey []byte
+
+	// bounds every single RPC call, 0 leaves it to the context of the run
+	callTimeout time.Duration
 }
 
 func (c *Client) init() {
 	id_bytes := make([]byte, 32)
     rand.Read(id_bytes)
 	c.id = fmt.Sprintf("%x", id_bytes)
+
+	// keys only live in memory unless a key ring loaded from a keyfile is set
+	c.keyring = &KeyRing{Keys: make(map[string]string)}
 }
 
-func (c *Client) BookServerBudget(address string, budget int) error {
+// call is call bounded by the call timeout of the client, a hung node fails
+// the call with ErrTimeout while ctx only carries the cancellation of the run
+func (c *Client) call(ctx context.Context, address string, rpcname string, args interface{}, reply interface{}) error {
+	if c.callTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.callTimeout)
+		defer cancel()
+	}
+
+	return call(ctx, address, rpcname, args, reply)
+}
+
+func (c *Client) BookServerBudget(ctx context.Context, address string, budget int) error {
 
 	args := UploadRequestArgs{
 		RequiredBudget: budget, 
 		RequesterID: c.id,
+		Compression: c.storageCompression,
 	}
 
     var reply UploadRequestReply
 	
-	err := call(address, "Node.UploadRequest", &args, &reply)
+	err := c.call(ctx, address, "Node.UploadRequest", &args, &reply)
 
 	if err != nil {
 		return err
@@ -39,16 +75,34 @@ func (c *Client) BookServerBudget(address string, budget int) error {
 	return nil
 }
 
-func (c *Client) uploadCohort(address string, files map[string]string) (err error, uploaded []string) {
+func (c *Client) uploadCohort(ctx context.Context, address string, files map[string]string) (err error, uploaded []string) {
+
+	codec := CompressionNone
+	if c.wireCompression {
+		// nodes that don't know about compression don't report any codec
+		if err, info := c.NodeInfo(ctx, address); err == nil && slices.Contains(info.Compressions, CompressionGzip) {
+			codec = CompressionGzip
+		}
+	}
+
+	compressed := make(map[string]string, len(files))
+	for hash, content := range files {
+		err, out := compress(codec, []byte(content))
+		if err != nil {
+			return err, nil
+		}
+		compressed[hash] = string(out)
+	}
 
 	args := UploadFilesArgs{
 		RequesterID: c.id, 
-		Files: files,
+		Files: compressed,
+		Compression: codec,
 	}
 
     var reply UploadFilesReply
 
-	err = call(address, "Node.UploadFiles", &args, &reply)
+	err = c.call(ctx, address, "Node.UploadFiles", &args, &reply)
 
 	if err != nil {
 		return err, nil
@@ -59,7 +113,7 @@ func (c *Client) uploadCohort(address string, files map[string]string) (err erro
 	return nil, reply.Uploaded
 }
 
-func (c *Client) UploadFiles(address string, filePaths []string, cohortSize int) (err error, uploadedHashes []string) {
+func (c *Client) UploadFiles(ctx context.Context, address string, filePaths []string, cohortSize int) (err error, uploadedHashes []string) {
 
 	files := make(map[string]string)
 
@@ -70,10 +124,23 @@ func (c *Client) UploadFiles(address string, filePaths []string, cohortSize int)
 			return err, uploadedHashes
 		}
 
+		// nodes only ever see, hash and prove ciphertext
+		if c.encrypt {
+			if c.collectionKey == nil {
+				if err, c.collectionKey = newCollectionKey(); err != nil {
+					return err, uploadedHashes
+				}
+			}
+
+			if err, dat = encryptFile(c.collectionKey, dat); err != nil {
+				return err, uploadedHashes
+			}
+		}
+
 		files[ComputeHash(string(dat))] = string(dat)
 
 		if (i+1)%cohortSize == 0 {
-			err, uploaded := c.uploadCohort(address, files)
+			err, uploaded := c.uploadCohort(ctx, address, files)
 
 			if err != nil {
 				return err, uploadedHashes
@@ -94,7 +161,7 @@ func (c *Client) UploadFiles(address string, filePaths []string, cohortSize int)
 
 	// upload the last cohort
 	if len(filePaths) < len(uploadedHashes) && files != nil {
-		err, uploaded := c.uploadCohort(address, files)
+		err, uploaded := c.uploadCohort(ctx, address, files)
 		if err != nil {
 			return err, uploadedHashes
 		}
@@ -113,7 +180,7 @@ func (c *Client) UploadFiles(address string, filePaths []string, cohortSize int)
 	return nil, uploadedHashes
 }
 
-func (c *Client) CommitFiles(address string, uploadedHashes []string) (err error, merkle string) {
+func (c *Client) CommitFiles(ctx context.Context, address string, uploadedHashes []string) (err error, merkle string) {
 	
 	commitArgs := CommitFilesArgs{
 		Hashes: uploadedHashes,
@@ -122,7 +189,7 @@ func (c *Client) CommitFiles(address string, uploadedHashes []string) (err error
 	var commitReply CommitFilesReply
 
 	// Commit files on server
-	err = call(address, "Node.CommitFiles", &commitArgs, &commitReply)
+	err = c.call(ctx, address, "Node.CommitFiles", &commitArgs, &commitReply)
 	if err != nil {
 		return err, ""
 	}
@@ -145,41 +212,220 @@ func (c *Client) CommitFiles(address string, uploadedHashes []string) (err error
 		return errors.New("Merkle root doesn't match"), ""
 	}
 
+	if c.collectionKey != nil {
+		c.keyring.Add(t.root.hash, c.collectionKey)
+		if err := c.keyring.save(); err != nil {
+			return err, ""
+		}
+		c.collectionKey = nil
+	}
+
 	return nil, t.root.hash
 }
 
-func (c *Client) DownloadFile(address string, merkle string, index int) (err error, content string) {
+// CorruptedDataError names the node that served content failing the proof
+type CorruptedDataError struct {
+	Address string
+	NodeID string
+}
+
+func (e *CorruptedDataError) Error() string {
+	if e.NodeID == "" {
+		return fmt.Sprintf("Node %s served a corrupted file!", e.Address)
+	}
+
+	return fmt.Sprintf("Node %s (%s) served a corrupted file!", e.NodeID, e.Address)
+}
+
+func (c *Client) NodeInfo(ctx context.Context, address string) (err error, info NodeInfoReply) {
+	err = c.call(ctx, address, "Node.Info", &NodeInfoArgs{}, &info)
+	return err, info
+}
+
+// Events fetches the role and marriage changes of a node, e.g. a replica promoted after its primary died
+func (c *Client) Events(ctx context.Context, address string, since int) (err error, reply EventsReply) {
+	err = c.call(ctx, address, "Node.Events", &EventsArgs{Since: since}, &reply)
+	return err, reply
+}
+
+// DownloadFile fetches and verifies a file and decrypts it when its collection
+// key is known. When the proof fails, or the node errors or times out, the
+// download is retried on every partner of the node in turn, a node that served
+// bad data is reported either way.
+func (c *Client) DownloadFile(ctx context.Context, address string, merkle string, index int) (err error, content string) {
+	err, content = c.downloadVerified(ctx, address, merkle, index)
+	if err != nil {
+		return err, ""
+	}
+
+	// collections without a key in the key ring were uploaded in plaintext
+	err, key := c.keyring.Get(merkle)
+	if err != nil || key == nil {
+		return err, content
+	}
+
+	err, plaintext := decryptFile(key, []byte(content))
+	if err != nil {
+		return err, ""
+	}
+
+	return nil, string(plaintext)
+}
+
+func (c *Client) downloadVerified(ctx context.Context, address string, merkle string, index int) (err error, content string) {
+	err, content = c.downloadFrom(ctx, address, merkle, index)
+	// nothing to retry once the whole run is cancelled
+	if err == nil || ctx.Err() != nil {
+		return err, content
+	}
+	failed := err
+
+	err, info := c.NodeInfo(ctx, address)
+	if err != nil {
+		return errors.Join(failed, err), ""
+	}
+
+	var corrupted *CorruptedDataError
+	if errors.As(failed, &corrupted) {
+		corrupted.NodeID = info.ID
+		fmt.Println(corrupted.Error())
+	} else {
+		fmt.Printf("Download from %s failed: %s\n", address, failed)
+	}
+
+	// nodes predating replication factors only report a single partner
+	partners, addresses := info.Partners, info.PartnerAddresses
+	if len(addresses) == 0 && info.PartnerAddress != "" {
+		partners, addresses = []string{info.MarriedTo}, []string{info.PartnerAddress}
+	}
+
+	if !info.MaritalStatus || len(addresses) == 0 {
+		return errors.Join(failed, errors.New("Node has no partner to retry on")), ""
+	}
+
+	errs := []error{failed}
+	for i, partnerAddress := range addresses {
+		fmt.Printf("Retrying download on partner %s (%s)\n", partners[i], partnerAddress)
+
+		err, content = c.downloadFrom(ctx, partnerAddress, merkle, index)
+		if err == nil {
+			return nil, content
+		}
+
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...), ""
+}
+
+func (c *Client) downloadFrom(ctx context.Context, address string, merkle string, index int) (err error, content string) {
 	args := DownloadFileArgs{
 		Merkle: merkle,
 		Index: index,
 	}
+	if c.wireCompression {
+		args.AcceptCompression = supportedCompressions
+	}
 	var reply DownloadFileReply
 
-	err = call(address, "Node.DownloadFile", &args, &reply)
+	err = c.call(ctx, address, "Node.DownloadFile", &args, &reply)
 	if err != nil {
 		return err, ""
 	}
 
-	if !VerifyProof(reply.Content, reply.Proof, merkle) {
-		return errors.New("The file is corrupted!"), ""
+	// proofs are over the uncompressed content
+	err, decompressed := decompress(reply.Compression, []byte(reply.Content))
+	if err != nil {
+		return &CorruptedDataError{Address: address}, ""
+	}
+
+	if !VerifyProof(string(decompressed), reply.Proof, merkle) {
+		return &CorruptedDataError{Address: address}, ""
 	}
 
-	return nil, reply.Content
+	return nil, string(decompressed)
 }
 
 func main() {
 	upload := flag.Bool("upload", false, "mock upload files to the server")
 	merkle := flag.String("merkle", "", "merkle root hash")
-	ip := flag.String("ip", "", "ip of the server")
+	ip := flag.String("ip", "", "ip or ip:port of the server")
 	index := flag.Int("index", 0, "the index of the file in the tree")
+	timeout := flag.Duration("timeout", 60*time.Second, "deadline for every single call to a node")
+	tlsCA := flag.String("tls-ca", "", "PEM CA certificate that signs the nodes, enables TLS")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate, needed when nodes run with --mtls")
+	tlsKey := flag.String("tls-key", "", "PEM private key of the client certificate")
+	storageCompression := flag.String("storage-compression", "", "ask nodes to store uploads compressed with none, gzip or zstd")
+	wireCompression := flag.Bool("wire-compression", true, "gzip file contents on the wire when the node supports it")
+	encrypt := flag.Bool("encrypt", false, "encrypt every uploaded collection with its own AES-GCM key")
+	keyfile := flag.String("keyfile", "2gud-keys.json", "where collection keys are kept")
+	exportKey := flag.String("export-key", "", "print the key of the collection with this merkle root and exit")
+	importKey := flag.String("import-key", "", "add a shared key given as <merkle root>:<key> to the keyfile and exit")
+	events := flag.Bool("events", false, "print the events of the node at --ip, such as promotions, and exit")
 	flag.Parse()
 
+	if *tlsCA != "" {
+		var err error
+		if err, tlsConfig = loadTLSConfig(*tlsCA, *tlsCert, *tlsKey); err != nil {
+			panic(err)
+		}
+	}
+
+	err, keyring := loadKeyRing(*keyfile)
+	if err != nil {
+		panic(err)
+	}
+
+	if *exportKey != "" {
+		err, key := keyring.Export(*exportKey)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("%s:%s\n", *exportKey, key)
+		return
+	}
+
+	if *importKey != "" {
+		root, key, ok := strings.Cut(*importKey, ":")
+		if !ok {
+			panic("--import-key expects <merkle root>:<key>")
+		}
+		if err := keyring.Import(root, key); err != nil {
+			panic(err)
+		}
+		if err := keyring.save(); err != nil {
+			panic(err)
+		}
+		return
+	}
+
+	// the run ends early on an interrupt, every call is bounded by --timeout on its own
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if *events {
+		err, reply := (&Client{callTimeout: *timeout}).Events(ctx, *ip, 0)
+		if err != nil {
+			panic(err)
+		}
+		for _, e := range reply.Events {
+			fmt.Printf("%d %s %s %s: %s\n", e.Seq, e.Time.Format(time.RFC3339), e.NodeID, e.Kind, e.Detail)
+		}
+		return
+	}
+
 	if *merkle == "" && *upload == false {
 		panic("merkle root can't be empty when downloading")
 	}
 
 	client := new(Client)
 	client.init()
+	client.storageCompression = *storageCompression
+	client.wireCompression = *wireCompression
+	client.encrypt = *encrypt
+	client.keyring = keyring
+	// a hung node fails its call fast with ErrTimeout
+	client.callTimeout = *timeout
 
 	addresses := []string{"172.10.0.2", "172.10.0.3", "172.10.0.4"}
 
@@ -204,56 +450,59 @@ func main() {
 		}
 		// Dirty code ends here
 
-		err := client.BookServerBudget(addresses[0], 300)
+		err := client.BookServerBudget(ctx, addresses[0], 300)
 		if err != nil {
 			panic(err)
 		}
 
-		err, uploadedHashes1 := client.UploadFiles(addresses[0], fileBatch1, 50)
+		err, uploadedHashes1 := client.UploadFiles(ctx, addresses[0], fileBatch1, 50)
 		if err != nil {
 			panic(err)
 		}
 
-		err, merkle1 := client.CommitFiles(addresses[0], uploadedHashes1)
+		err, merkle1 := client.CommitFiles(ctx, addresses[0], uploadedHashes1)
 		if err != nil {
 			panic(err)
 		}
 		fmt.Println(merkle1)
 
-		err = client.BookServerBudget(addresses[1], 300)
+		err = client.BookServerBudget(ctx, addresses[1], 300)
 		if err != nil {
 			panic(err)
 		}
 
-		err, uploadedHashes2 := client.UploadFiles(addresses[1], fileBatch2, 50)
+		err, uploadedHashes2 := client.UploadFiles(ctx, addresses[1], fileBatch2, 50)
 		if err != nil {
 			panic(err)
 		}
 
-		err, merkle2 := client.CommitFiles(addresses[1], uploadedHashes2)
+		err, merkle2 := client.CommitFiles(ctx, addresses[1], uploadedHashes2)
 		if err != nil {
 			panic(err)
 		}
 		fmt.Println(merkle2)
 
-		err = client.BookServerBudget(addresses[2], 400)
+		err = client.BookServerBudget(ctx, addresses[2], 400)
 		if err != nil {
 			panic(err)
 		}
 
-		err, uploadedHashes3 := client.UploadFiles(addresses[2], fileBatch3, 50)
+		err, uploadedHashes3 := client.UploadFiles(ctx, addresses[2], fileBatch3, 50)
 		if err != nil {
 			panic(err)
 		}
 
-		err, merkle3 := client.CommitFiles(addresses[2], uploadedHashes3)
+		err, merkle3 := client.CommitFiles(ctx, addresses[2], uploadedHashes3)
 		if err != nil {
 			panic(err)
 		}
 		fmt.Println(merkle3)
 	} else {
 
-		if err, content := client.DownloadFile(*ip, *merkle, *index); err != nil {
+		if err, content := client.DownloadFile(ctx, *ip, *merkle, *index); err != nil {
+			if errors.Is(err, ErrTimeout) {
+				fmt.Printf("Node %s did not answer within %s\n", *ip, *timeout)
+			}
 			panic(err)
 		} else {
 			fmt.Println(content)
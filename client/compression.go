@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// codecs the client can handle on the wire, nodes additionally know zstd
+var supportedCompressions = []string{CompressionGzip, CompressionNone}
+
+// upper bound of a decompressed file, guards against decompression bombs
+const maxDecompressedSize = 1 << 30
+
+func compress(codec string, data []byte) (err error, out []byte) {
+	switch codec {
+		case "", CompressionNone:
+			return nil, data
+		case CompressionGzip:
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			if _, err := w.Write(data); err != nil {
+				return err, nil
+			}
+			if err := w.Close(); err != nil {
+				return err, nil
+			}
+			return nil, buf.Bytes()
+		default:
+			return fmt.Errorf("unsupported compression %q", codec), nil
+	}
+}
+
+func decompress(codec string, data []byte) (err error, out []byte) {
+	switch codec {
+		case "", CompressionNone:
+			return nil, data
+		case CompressionGzip:
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return err, nil
+			}
+			defer r.Close()
+
+			out, err = io.ReadAll(io.LimitReader(r, maxDecompressedSize + 1))
+			if err != nil {
+				return err, nil
+			}
+			if len(out) > maxDecompressedSize {
+				return errors.New("decompressed file is too large"), nil
+			}
+			return nil, out
+		default:
+			return fmt.Errorf("unsupported compression %q", codec), nil
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// AES-256
+const collectionKeySize = 32
+
+// KeyRing maps merkle roots of encrypted collections to their hex encoded keys.
+// It is persisted as JSON, anyone holding a key can download and decrypt the collection.
+type KeyRing struct {
+	path string
+	Keys map[string]string `json:"keys"`
+}
+
+// loadKeyRing reads the keyfile at path, a missing file is an empty key ring
+func loadKeyRing(path string) (err error, ring *KeyRing) {
+	ring = &KeyRing{path: path, Keys: make(map[string]string)}
+
+	dat, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ring
+	} else if err != nil {
+		return fmt.Errorf("Error reading keyfile: %w", err), nil
+	}
+
+	if err := json.Unmarshal(dat, ring); err != nil {
+		return fmt.Errorf("Error parsing keyfile %s: %w", path, err), nil
+	}
+
+	if ring.Keys == nil {
+		ring.Keys = make(map[string]string)
+	}
+
+	return nil, ring
+}
+
+// save writes the key ring readable by the owner only, through a temp file so a crash never truncates it
+func (k *KeyRing) save() error {
+	if k.path == "" {
+		return nil
+	}
+
+	dat, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".keys-*")
+	if err != nil {
+		return fmt.Errorf("Error writing keyfile: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing keyfile: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error writing keyfile: %w", err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return fmt.Errorf("Error writing keyfile: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), k.path)
+}
+
+func (k *KeyRing) Get(merkle string) (err error, key []byte) {
+	encoded, ok := k.Keys[merkle]
+	if !ok {
+		return nil, nil
+	}
+
+	key, err = hex.DecodeString(encoded)
+	if err != nil || len(key) != collectionKeySize {
+		return errors.New("Key of collection " + merkle + " is malformed"), nil
+	}
+
+	return nil, key
+}
+
+func (k *KeyRing) Add(merkle string, key []byte) {
+	k.Keys[merkle] = hex.EncodeToString(key)
+}
+
+// Export returns the key of a collection for sharing, see Import
+func (k *KeyRing) Export(merkle string) (err error, encoded string) {
+	encoded, ok := k.Keys[merkle]
+	if !ok {
+		return errors.New("No key for collection " + merkle), ""
+	}
+
+	return nil, encoded
+}
+
+// Import adds a key exported by someone else
+func (k *KeyRing) Import(merkle string, encoded string) error {
+	key, err := hex.DecodeString(encoded)
+	if err != nil || len(key) != collectionKeySize {
+		return errors.New("Key must be 64 hex characters")
+	}
+
+	k.Add(merkle, key)
+
+	return nil
+}
+
+func newCollectionKey() (err error, key []byte) {
+	key = make([]byte, collectionKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return err, nil
+	}
+
+	return nil, key
+}
+
+// encryptFile seals plaintext with AES-GCM, the random nonce is prepended to the ciphertext
+func encryptFile(key []byte, plaintext []byte) (err error, ciphertext []byte) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err, nil
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize() + len(plaintext) + aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err, nil
+	}
+
+	return nil, aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+func decryptFile(key []byte, ciphertext []byte) (err error, plaintext []byte) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return err, nil
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return errors.New("Ciphertext is too short"), nil
+	}
+
+	plaintext, err = aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return errors.New("Decryption failed, wrong key?"), nil
+	}
+
+	return nil, plaintext
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
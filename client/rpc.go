@@ -1,5 +1,7 @@
 package main
 
+import "time"
+
 type HeartBeatArgs struct {
 	Sender string
 	Address string
@@ -16,6 +18,8 @@ type HeartBeatReply struct {
 type UploadRequestArgs struct {
 	RequiredBudget int
 	RequesterID string
+	// codec the booked files are stored with, empty uses the node default
+	Compression string
 }
 
 type UploadRequestReply struct {
@@ -25,7 +29,9 @@ type UploadRequestReply struct {
 
 type UploadFilesArgs struct {
 	RequesterID string
+	// contents are compressed with Compression, hashes are over the uncompressed contents
 	Files map[string]string
+	Compression string
 }
 
 type UploadFilesReply struct {
@@ -46,11 +52,13 @@ type CommitFilesReply struct {
 type DownloadFileArgs struct {
 	Merkle string
 	Index int
+	AcceptCompression []string
 }
 
 type DownloadFileReply struct {
 	Proof []string
 	Content string
+	Compression string
 }
 
 type ReplicateArgs struct {
@@ -72,4 +80,36 @@ type ProposeReplicationArgs struct {
 type ProposeReplicationReply struct {
 	replicaFor string
 	granted bool
-}
\ No newline at end of file
+}
+
+type NodeInfoArgs struct {
+}
+
+type NodeInfoReply struct {
+	ID string
+	Address string
+	IsPrimary bool
+	MaritalStatus bool
+	MarriedTo string
+	PartnerAddress string
+	Partners []string
+	PartnerAddresses []string
+	Compressions []string
+}
+
+type Event struct {
+	Seq int
+	Time time.Time
+	Kind string
+	NodeID string
+	Detail string
+}
+
+type EventsArgs struct {
+	Since int
+}
+
+type EventsReply struct {
+	Events []Event
+	Next int
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// tlsConfig is used by call for every connection to a node, nil means plaintext.
+var tlsConfig *tls.Config
+
+// loadTLSConfig trusts only node certificates signed by caFile.
+// certFile and keyFile are optional and only needed when nodes require mutual TLS.
+func loadTLSConfig(caFile string, certFile string, keyFile string) (err error, config *tls.Config) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return fmt.Errorf("Error reading CA certificate: %w", err), nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return errors.New("No certificates found in " + caFile), nil
+	}
+
+	config = &tls.Config{
+		RootCAs: pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("Error loading client certificate: %w", err), nil
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return nil, config
+}
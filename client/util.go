@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"crypto/sha256"
 	"os"
 	"net/rpc"
 	"net"
+	"strings"
 )
 
 func ComputeHash(content string) string {
@@ -43,20 +49,89 @@ func readFile(node_id string, hash string) (err error, content string) {
 	return nil, content
 }
 
-// send an RPC request to the coordinator, wait for the response.
-// usually returns true.
-// returns false if something goes wrong.
+// port assumed for addresses that don't carry one
+const defaultPort = "8080"
+
+// ErrTimeout is returned (wrapped) by call whenever the peer did not answer
+// before the context deadline, so callers can tell a slow or hung peer apart
+// from one that actively refused the request.
+var ErrTimeout = errors.New("RPC call timed out")
+
+// send an RPC request to a peer and wait for the response.
+// the call is abandoned as soon as ctx is cancelled or its deadline passes,
+// a connection is never left blocking the caller.
 //
-func call(ip string, rpcname string, args interface{}, reply interface{}) (e error) {
-	c, err := rpc.DialHTTP("tcp", ip + ":8080")
+func call(ctx context.Context, address string, rpcname string, args interface{}, reply interface{}) (e error) {
+	address = withDefaultPort(address)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return callError(ctx, address, rpcname, err)
+	}
+	defer conn.Close()
+
+	if tlsConfig != nil {
+		// node certificates carry their IPs as SANs
+		host, _, _ := net.SplitHostPort(address)
+		config := tlsConfig.Clone()
+		config.ServerName = host
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return callError(ctx, address, rpcname, err)
+		}
+		conn = tlsConn
+	}
+
+	// reads and writes on the raw connection must not outlive the context either
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// same handshake as rpc.DialHTTP, which has no context aware variant
+	io.WriteString(conn, "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
 	if err != nil {
-		return err
+		return callError(ctx, address, rpcname, err)
+	}
+	if resp.Status != "200 Connected to Go RPC" {
+		return errors.New("unexpected HTTP response: " + resp.Status)
 	}
+
+	c := rpc.NewClient(conn)
 	defer c.Close()
 
-	err = c.Call(rpcname, args, reply)
-	if err == nil {
-		return nil
+	pending := c.Go(rpcname, args, reply, make(chan *rpc.Call, 1))
+	select {
+		case <-ctx.Done():
+			return callError(ctx, address, rpcname, ctx.Err())
+		case res := <-pending.Done:
+			if res.Error != nil {
+				return callError(ctx, address, rpcname, res.Error)
+			}
+	}
+
+	return nil
+}
+
+// withDefaultPort appends defaultPort to a bare IPv4, IPv6 or host name
+func withDefaultPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+
+	return net.JoinHostPort(strings.Trim(address, "[]"), defaultPort)
+}
+
+func callError(ctx context.Context, address string, rpcname string, err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %s on %s", ErrTimeout, rpcname, address)
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("%s on %s cancelled: %w", rpcname, address, ctx.Err())
 	}
 
 	return err
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	SyncFiles = "files"
+	SyncTrees = "trees"
+)
+
+// hashes are hex, every differing range splits into one sub range per digit
+const syncDigits = "0123456789abcdef"
+
+// ranges holding at most this many hashes on both sides are compared hash by hash
+const syncLeafSize = 64
+
+// RangeSummary condenses the sorted hashes sharing a prefix
+type RangeSummary struct {
+	Count int
+	Digest string
+}
+
+// summarize digests the hashes of sorted starting with prefix
+func summarize(sorted []string, prefix string) RangeSummary {
+	hashes := hashRange(sorted, prefix)
+	if len(hashes) == 0 {
+		return RangeSummary{}
+	}
+
+	return RangeSummary{
+		Count: len(hashes),
+		Digest: ComputeHash(strings.Join(hashes, "")),
+	}
+}
+
+func hashRange(sorted []string, prefix string) []string {
+	start := sort.SearchStrings(sorted, prefix)
+	end := start
+	for end < len(sorted) && strings.HasPrefix(sorted[end], prefix) {
+		end++
+	}
+
+	return sorted[start:end]
+}
+
+// syncSet lists what this node holds on behalf of the partnership with partner:
+// a primary everything it committed, a replica what partner committed to it.
+// Callers hold n.lock.
+func (n *Node) syncSet(kind string, partner string) []string {
+	var hashes []string
+
+	switch kind {
+		case SyncFiles:
+			for hash, status := range n.fileStatusTable {
+				if status == 0 {
+					continue
+				}
+				if !n.isPrimary && n.fileOwners[hash] != partner {
+					continue
+				}
+				hashes = append(hashes, hash)
+			}
+		case SyncTrees:
+			for root := range n.trees {
+				hashes = append(hashes, root)
+			}
+	}
+
+	sort.Strings(hashes)
+
+	return hashes
+}
+
+// Sync summarizes the requested ranges of files or trees for a partner, or lists them with args.List
+func (n *Node) Sync(args *SyncArgs, reply *SyncReply) error {
+	if args.Kind != SyncFiles && args.Kind != SyncTrees {
+		return errors.New("Unknown sync kind " + args.Kind)
+	}
+
+	n.lock.Lock()
+	if !n.isPartner(args.RequesterID) {
+		n.lock.Unlock()
+		return errors.New("Not my partner!")
+	}
+
+	set := n.syncSet(args.Kind, args.RequesterID)
+	n.lock.Unlock()
+
+	for _, prefix := range args.Prefixes {
+		if args.List {
+			reply.Hashes = append(reply.Hashes, hashRange(set, prefix))
+		} else {
+			reply.Summaries = append(reply.Summaries, summarize(set, prefix))
+		}
+	}
+
+	return nil
+}
+
+// FetchTree hands the leaf positions of a tree to a partner
+func (n *Node) FetchTree(args *FetchTreeArgs, reply *FetchTreeReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !n.isPartner(args.RequesterID) {
+		return errors.New("Not my partner!")
+	}
+
+	t, ok := n.trees[args.Merkle]
+	if !ok {
+		return errors.New("Merkle hash provided doesn't exist on this node")
+	}
+
+	reply.IndexMap = t.hashToIndex
+
+	return nil
+}
+
+// runAntiEntropy reconciles with every replica once per anti entropy interval until ctx is cancelled
+func (n *Node) runAntiEntropy(ctx context.Context) {
+	ticker := time.NewTicker(n.config.AntiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-ticker.C:
+				n.lock.Lock()
+				isPrimary, partners := n.isPrimary, n.partners()
+				n.lock.Unlock()
+
+				if !isPrimary || n.config.Redundancy != RedundancyMarriage {
+					continue
+				}
+				for _, replica := range partners {
+					if err := n.reconcile(ctx, replica); err != nil {
+						fmt.Printf("Anti entropy with %s failed: %s\n", replica, err)
+					}
+				}
+			case <-ctx.Done():
+				return
+		}
+	}
+}
+
+// reconcile compares files, then trees, with replica and repairs both sides.
+// Files the replica lost lose their acknowledgement and are replicated again,
+// files and trees only the replica holds are pulled back to the primary.
+func (n *Node) reconcile(ctx context.Context, replica string) error {
+	n.lock.Lock()
+	if _, ok := n.replicas[replica]; !ok {
+		n.lock.Unlock()
+		return errors.New("Not my replica")
+	}
+
+	peer, ok := n.peerTable[replica]
+	if !ok {
+		n.lock.Unlock()
+		return errors.New("Replica is not in the peer table")
+	}
+
+	files := n.syncSet(SyncFiles, replica)
+	n.lock.Unlock()
+
+	err, onlyMine, onlyTheirs := n.diff(ctx, peer.address, SyncFiles, files)
+	if err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	for _, hash := range onlyMine {
+		n.unacknowledgeFile(replica, hash)
+	}
+	n.lock.Unlock()
+
+	recovered := 0
+	for _, hash := range onlyTheirs {
+		// reserved before the pull, like a booking, so concurrent uploads can't overdraw the budget
+		n.lock.Lock()
+		if n.fileBudget < 1 {
+			n.lock.Unlock()
+			fmt.Printf("No budget left to pull %d files back from %s\n", len(onlyTheirs) - recovered, replica)
+			break
+		}
+		n.fileBudget--
+		n.lock.Unlock()
+
+		err, content := n.fetchFrom(ctx, replica, hash)
+		if err == nil {
+			n.lock.Lock()
+			codec := n.fileCodec(hash)
+			n.lock.Unlock()
+			err = n.writeBlob(hash, []byte(content), codec)
+		}
+		if err != nil {
+			fmt.Printf("Could not pull %s from %s: %s\n", hash, replica, err)
+			n.lock.Lock()
+			n.fileBudget++
+			n.lock.Unlock()
+			continue
+		}
+
+		n.lock.Lock()
+		// uploaded again meanwhile, that upload already paid for it
+		if _, ok := n.fileStatusTable[hash]; ok {
+			n.fileBudget++
+		}
+		n.fileStatusTable[hash] = 1
+		n.markFileReplicated(replica, hash)
+		n.lock.Unlock()
+		recovered++
+	}
+
+	// trees only make sense once their leaves are back
+	n.lock.Lock()
+	trees := n.syncSet(SyncTrees, replica)
+	n.lock.Unlock()
+
+	err, missingTrees, extraTrees := n.diff(ctx, peer.address, SyncTrees, trees)
+	if err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	for _, root := range missingTrees {
+		n.unacknowledgeTree(replica, root)
+	}
+	n.lock.Unlock()
+
+	for _, root := range extraTrees {
+		if err := n.pullTree(ctx, peer.address, replica, root); err != nil {
+			fmt.Printf("Could not pull tree %s from %s: %s\n", root, replica, err)
+		}
+	}
+
+	if len(onlyMine) + len(onlyTheirs) + len(missingTrees) + len(extraTrees) > 0 {
+		fmt.Printf("Anti entropy with %s: %d files and %d trees missing there, %d of %d files and %d trees pulled back\n",
+			replica,
+			len(onlyMine),
+			len(missingTrees),
+			recovered,
+			len(onlyTheirs),
+			len(extraTrees),
+		)
+		n.saveState()
+	}
+
+	return nil
+}
+
+// diff walks down the ranges whose summaries differ and returns the hashes only one side holds
+func (n *Node) diff(ctx context.Context, address string, kind string, local []string) (err error, onlyMine []string, onlyTheirs []string) {
+	prefixes := []string{""}
+
+	for len(prefixes) > 0 {
+		err, summaries := n.syncCall(ctx, address, kind, prefixes, false)
+		if err != nil {
+			return err, nil, nil
+		}
+
+		var next, leaves []string
+		for i, prefix := range prefixes {
+			mine := summarize(local, prefix)
+			if mine == summaries.Summaries[i] {
+				continue
+			}
+
+			if max(mine.Count, summaries.Summaries[i].Count) <= syncLeafSize || len(prefix) == 64 {
+				leaves = append(leaves, prefix)
+				continue
+			}
+
+			for _, digit := range syncDigits {
+				next = append(next, prefix + string(digit))
+			}
+		}
+
+		if len(leaves) > 0 {
+			err, listed := n.syncCall(ctx, address, kind, leaves, true)
+			if err != nil {
+				return err, nil, nil
+			}
+
+			for i, prefix := range leaves {
+				mine, theirs := setDifference(hashRange(local, prefix), listed.Hashes[i])
+				onlyMine = append(onlyMine, mine...)
+				onlyTheirs = append(onlyTheirs, theirs...)
+			}
+		}
+
+		prefixes = next
+	}
+
+	return nil, onlyMine, onlyTheirs
+}
+
+func (n *Node) syncCall(ctx context.Context, address string, kind string, prefixes []string, list bool) (err error, reply SyncReply) {
+	args := SyncArgs{
+		RequesterID: n.id,
+		Kind: kind,
+		Prefixes: prefixes,
+		List: list,
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.CallTimeout)
+	defer cancel()
+
+	if err := call(ctx, address, "Node.Sync", &args, &reply); err != nil {
+		return err, SyncReply{}
+	}
+
+	if len(reply.Summaries) + len(reply.Hashes) != len(prefixes) {
+		return errors.New("Partner answered a different number of ranges"), SyncReply{}
+	}
+
+	return nil, reply
+}
+
+func (n *Node) pullTree(ctx context.Context, address string, replica string, root string) error {
+	args := FetchTreeArgs{
+		RequesterID: n.id,
+		Merkle: root,
+	}
+	var reply FetchTreeReply
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.TransferTimeout)
+	defer cancel()
+
+	if err := call(ctx, address, "Node.FetchTree", &args, &reply); err != nil {
+		return err
+	}
+
+	err, t := treeFromIndexMap(reply.IndexMap)
+	if err != nil {
+		return err
+	}
+
+	if t.root.hash != root {
+		return errors.New("The replication does not match the original!")
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for hash := range t.hashToIndex {
+		if n.fileStatusTable[hash] == 0 {
+			return errors.New("Leaf " + hash + " is not committed here")
+		}
+	}
+
+	n.trees[root] = t
+	n.treesStatus[root] = 0
+	n.markTreeReplicated(replica, root)
+
+	return nil
+}
+
+// setDifference splits two sorted lists into what only a and only b hold
+func setDifference(a []string, b []string) (onlyA []string, onlyB []string) {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+			case a[i] == b[j]:
+				i++
+				j++
+			case a[i] < b[j]:
+				onlyA = append(onlyA, a[i])
+				i++
+			default:
+				onlyB = append(onlyB, b[j])
+				j++
+		}
+	}
+
+	onlyA = append(onlyA, a[i:]...)
+	onlyB = append(onlyB, b[j:]...)
+
+	return onlyA, onlyB
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// marry runs heartbeat rounds until primary is married to replica
+func marry(t *testing.T, primary *Node, replica *Node) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	introduce(t, ctx, primary, replica)
+
+	var rounds sync.WaitGroup
+	tick(ctx, &rounds, primary, replica)
+	defer rounds.Wait()
+	defer cancel()
+
+	eventually(t, 5 * time.Second, "the marriage", func() bool {
+		primary.lock.Lock()
+		_, married := primary.replicas[replica.id]
+		primary.lock.Unlock()
+
+		replica.lock.Lock()
+		defer replica.lock.Unlock()
+		return married && replica.marriedTo == primary.id
+	})
+}
+
+func TestReconcilePullsNoMoreThanTheBudget(t *testing.T) {
+	primary := startNode(t, true, func(c *Config) { c.Budget = 2 })
+	replica := startNode(t, false, nil)
+	marry(t, primary, replica)
+
+	// files only the replica holds, e.g. a primary that lost its disk
+	files := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		content := fmt.Sprintf("lost file %d", i)
+		files[ComputeHash(content)] = content
+	}
+	if err := upload(replica, primary.id, CompressionNone, files); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primary.reconcile(context.Background(), replica.id); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.lock.Lock()
+	defer primary.lock.Unlock()
+	if primary.fileBudget != 0 || len(primary.fileStatusTable) != 2 {
+		t.Fatalf("pulled %d files leaving a budget of %d, want 2 and 0", len(primary.fileStatusTable), primary.fileBudget)
+	}
+}
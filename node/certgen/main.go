@@ -0,0 +1,175 @@
+// certgen mints a local CA and certificates signed by it for test clusters.
+//
+//	go run ./certgen --out certs --name node1 --hosts 172.10.0.2
+//	go run ./certgen --out certs --name client
+//
+// The CA (ca.pem, ca-key.pem) is created in the output directory on first use
+// and reused afterwards, so every certificate minted into the same directory
+// belongs to the same cluster. Certificates are valid for both server and
+// client authentication, which is what mutual TLS between peers needs.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func main() {
+	out := flag.String("out", "certs", "directory holding the CA and the minted certificates")
+	name := flag.String("name", "", "name of the certificate, written to <out>/<name>.pem and <out>/<name>-key.pem")
+	hosts := flag.String("hosts", "", "comma separated IPs and DNS names the certificate is valid for")
+	validity := flag.Duration("validity", 365*24*time.Hour, "how long the minted certificates are valid")
+	flag.Parse()
+
+	if err := os.MkdirAll(*out, 0700); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	err, ca, caKey := loadOrCreateCA(*out, *validity)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	if *name == "" {
+		return
+	}
+
+	if err := mintCertificate(*out, *name, *hosts, *validity, ca, caKey); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Minted %s\n", filepath.Join(*out, *name + ".pem"))
+}
+
+func loadOrCreateCA(dir string, validity time.Duration) (err error, ca *x509.Certificate, key *ecdsa.PrivateKey) {
+	certPath := filepath.Join(dir, "ca.pem")
+	keyPath := filepath.Join(dir, "ca-key.pem")
+
+	if certPEM, err := os.ReadFile(certPath); err == nil {
+		keyPEM, err := os.ReadFile(keyPath)
+		if err != nil {
+			return err, nil, nil
+		}
+
+		certBlock, _ := pem.Decode(certPEM)
+		keyBlock, _ := pem.Decode(keyPEM)
+		if certBlock == nil || keyBlock == nil {
+			return errors.New("CA files in " + dir + " are not PEM encoded"), nil, nil
+		}
+
+		ca, err := x509.ParseCertificate(certBlock.Bytes)
+		if err != nil {
+			return err, nil, nil
+		}
+
+		key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+		if err != nil {
+			return err, nil, nil
+		}
+
+		return nil, ca, key
+	}
+
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{Organization: []string{"2GUD"}, CommonName: "2GUD test CA"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(validity),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	if err := writeKeyPair(certPath, keyPath, der, key); err != nil {
+		return err, nil, nil
+	}
+
+	ca, err = x509.ParseCertificate(der)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	fmt.Printf("Created CA %s\n", certPath)
+
+	return nil, ca, key
+}
+
+func mintCertificate(dir string, name string, hosts string, validity time.Duration, ca *x509.Certificate, caKey *ecdsa.PrivateKey) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: randomSerial(),
+		Subject: pkix.Name{Organization: []string{"2GUD"}, CommonName: name},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(validity),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	return writeKeyPair(filepath.Join(dir, name + ".pem"), filepath.Join(dir, name + "-key.pem"), der, key)
+}
+
+func writeKeyPair(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) error {
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		return err
+	}
+
+	return os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
+
+func randomSerial() *big.Int {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CompressionNone = "none"
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+)
+
+// codecs this node understands, in order of preference
+var supportedCompressions = []string{CompressionZstd, CompressionGzip, CompressionNone}
+
+// upper bound of a decompressed file, guards against decompression bombs
+const maxDecompressedSize = 1 << 30
+
+// stored blobs start with blobMagic and a codec id, blobs written before
+// compression existed carry no header and are read as they are
+var blobMagic = []byte("2GUD")
+
+var blobCodecIDs = map[string]byte{
+	CompressionNone: 0,
+	CompressionGzip: 1,
+	CompressionZstd: 2,
+}
+
+// EncodeAll and DecodeAll are safe for concurrent use
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxDecompressedSize))
+
+func isSupportedCompression(codec string) bool {
+	return codec == "" || slices.Contains(supportedCompressions, codec)
+}
+
+// negotiateCompression picks our most preferred codec the other side offered
+func negotiateCompression(offered []string) string {
+	for _, codec := range supportedCompressions {
+		if slices.Contains(offered, codec) {
+			return codec
+		}
+	}
+
+	return CompressionNone
+}
+
+func compress(codec string, data []byte) (err error, out []byte) {
+	switch codec {
+		case "", CompressionNone:
+			return nil, data
+		case CompressionGzip:
+			var buf bytes.Buffer
+			w := gzip.NewWriter(&buf)
+			if _, err := w.Write(data); err != nil {
+				return err, nil
+			}
+			if err := w.Close(); err != nil {
+				return err, nil
+			}
+			return nil, buf.Bytes()
+		case CompressionZstd:
+			return nil, zstdEncoder.EncodeAll(data, nil)
+		default:
+			return fmt.Errorf("unsupported compression %q", codec), nil
+	}
+}
+
+func decompress(codec string, data []byte) (err error, out []byte) {
+	switch codec {
+		case "", CompressionNone:
+			return nil, data
+		case CompressionGzip:
+			r, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return err, nil
+			}
+			defer r.Close()
+
+			out, err = io.ReadAll(io.LimitReader(r, maxDecompressedSize + 1))
+			if err != nil {
+				return err, nil
+			}
+			if len(out) > maxDecompressedSize {
+				return errors.New("decompressed file is too large"), nil
+			}
+			return nil, out
+		case CompressionZstd:
+			out, err := zstdDecoder.DecodeAll(data, nil)
+			if err != nil {
+				return err, nil
+			}
+			return nil, out
+		default:
+			return fmt.Errorf("unsupported compression %q", codec), nil
+	}
+}
+
+// encodeBlob frames content compressed with codec for the blob store
+func encodeBlob(codec string, content []byte) (err error, blob []byte) {
+	if codec == "" {
+		codec = CompressionNone
+	}
+
+	err, compressed := compress(codec, content)
+	if err != nil {
+		return err, nil
+	}
+
+	blob = make([]byte, 0, len(blobMagic) + 1 + len(compressed))
+	blob = append(blob, blobMagic...)
+	blob = append(blob, blobCodecIDs[codec])
+	blob = append(blob, compressed...)
+
+	return nil, blob
+}
+
+// decodeBlob returns the original content of a stored blob. Blobs are content
+// addressed, so a raw blob that happens to start with the magic is recognised
+// by its hash and returned untouched.
+func decodeBlob(hash string, blob []byte) []byte {
+	if !bytes.HasPrefix(blob, blobMagic) || len(blob) <= len(blobMagic) {
+		return blob
+	}
+
+	for codec, id := range blobCodecIDs {
+		if blob[len(blobMagic)] != id {
+			continue
+		}
+
+		err, content := decompress(codec, blob[len(blobMagic)+1:])
+		if err == nil && ComputeHash(string(content)) == hash {
+			return content
+		}
+	}
+
+	// either a raw blob or a corrupted one, hash checks downstream tell them apart
+	return blob
+}
+
+// readBlob returns the uncompressed content of hash
+func (n *Node) readBlob(hash string) (err error, content []byte) {
+	err, blob := n.store.Get(hash)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, decodeBlob(hash, blob)
+}
+
+// writeBlob stores content compressed with codec, "" uses the configured default.
+// Callers must not hold n.lock.
+func (n *Node) writeBlob(hash string, content []byte, codec string) error {
+	if codec == "" {
+		codec = n.config.Compression
+	}
+
+	err, blob := encodeBlob(codec, content)
+	if err != nil {
+		return err
+	}
+
+	if err := n.store.Put(hash, blob); err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	n.fileCodecs[hash] = codec
+	n.lock.Unlock()
+
+	return nil
+}
+
+// fileCodec is the at rest codec of hash, blobs stored before codecs were
+// tracked are assumed to use the configured default. Called with n.lock held.
+func (n *Node) fileCodec(hash string) string {
+	if codec, ok := n.fileCodecs[hash]; ok {
+		return codec
+	}
+
+	return n.config.Compression
+}
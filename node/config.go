@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// prefix of every environment variable overriding the config file,
+// nested keys are joined by '_', e.g. TWOGUD_TLS_CERT for tls.cert
+const envPrefix = "TWOGUD"
+
+// printed in place of credentials by --print-config
+const redactedSecret = "<redacted>"
+
+type TLSConfig struct {
+	Cert string `yaml:"cert"`
+	Key string `yaml:"key"`
+	CA string `yaml:"ca"`
+	Mutual bool `yaml:"mutual"`
+}
+
+type S3Config struct {
+	// host[:port] of the service, e.g. minio:9000 or s3.eu-central-1.amazonaws.com
+	Endpoint string `yaml:"endpoint"`
+	Bucket string `yaml:"bucket"`
+	// objects are stored as <prefix>/<node id>/<hash>
+	Prefix string `yaml:"prefix"`
+	Region string `yaml:"region"`
+	AccessKey string `yaml:"access_key"`
+	SecretKey string `yaml:"secret_key"`
+	// use https towards the service
+	Secure bool `yaml:"secure"`
+	CreateBucket bool `yaml:"create_bucket"`
+}
+
+// Config holds every tunable of a node. Values are layered as
+// defaults < config file < environment < explicitly set flags.
+type Config struct {
+	Primary bool `yaml:"primary"`
+	Budget int `yaml:"budget"`
+
+	Listen string `yaml:"listen"`
+	Port string `yaml:"port"`
+	Advertise string `yaml:"advertise"`
+	TLS TLSConfig `yaml:"tls"`
+
+	// "local", "s3" or "memory"
+	StorageBackend string `yaml:"storage_backend"`
+	// local blobs are kept under <storage_path>/<node id>/
+	StoragePath string `yaml:"storage_path"`
+	// levels of two hex character subdirectories below the node directory
+	StorageShardDepth int `yaml:"storage_shard_depth"`
+	// fsync every blob and its directory before acknowledging a write
+	StorageFsync bool `yaml:"storage_fsync"`
+	S3 S3Config `yaml:"s3"`
+	// codec blobs are stored with unless a booking asks for another: none, gzip or zstd
+	Compression string `yaml:"compression"`
+	// compress file contents on the wire when the other side supports it
+	WireCompression bool `yaml:"wire_compression"`
+
+	HeartBeatInterval time.Duration `yaml:"heartbeat_interval"`
+	// silence after which a peer is reported dead whatever its phi
+	DeathThreshold time.Duration `yaml:"death_threshold"`
+	// dead peers are forgotten once dead this long, time enough to gossip their death; 0 keeps them
+	DeadPeerRetention time.Duration `yaml:"dead_peer_retention"`
+	// phi accrual failure detector: a peer is suspected from phi_suspect_threshold
+	// on and reported dead from phi_death_threshold on, unless an indirect probe reaches it
+	PhiSuspectThreshold float64 `yaml:"phi_suspect_threshold"`
+	PhiDeathThreshold float64 `yaml:"phi_death_threshold"`
+	// floor of the heartbeat interval deviation, keeps very regular peers from being suspected on the first hiccup
+	PhiMinStdDeviation time.Duration `yaml:"phi_min_std_deviation"`
+	// pause (GC, network blip) tolerated on top of the mean heartbeat interval
+	PhiAcceptablePause time.Duration `yaml:"phi_acceptable_pause"`
+	// peers asked to reach a suspected peer on our behalf
+	IndirectProbes int `yaml:"indirect_probes"`
+	// peers heartbeated per round besides the partners, membership spreads by gossip; < 1 heartbeats every peer
+	GossipFanout int `yaml:"gossip_fanout"`
+
+	DiscoveryInterval time.Duration `yaml:"discovery_interval"`
+	// discovery rounds that fail or find nobody new back off up to this interval
+	DiscoveryMaxInterval time.Duration `yaml:"discovery_max_interval"`
+	// host[:port] of peers always sent a first heartbeat, from a file, TWOGUD_PEERS or --peers (comma separated)
+	Peers []string `yaml:"peers"`
+	// SRV name (starting with '_') or host[:port] whose A/AAAA records are peers
+	DiscoveryDNS string `yaml:"discovery_dns"`
+	// file listing one host[:port] per line, read again whenever it changes
+	DiscoveryFile string `yaml:"discovery_file"`
+	// listen for peerdiscovery broadcasts on the local network
+	DiscoveryMulticast bool `yaml:"discovery_multicast"`
+	// peers discovered per round, < 1 is unlimited
+	DiscoveryLimit int `yaml:"discovery_limit"`
+	// how long a single discovery round listens for broadcasts
+	DiscoveryTimeLimit time.Duration `yaml:"discovery_time_limit"`
+
+	CallTimeout time.Duration `yaml:"call_timeout"`
+	TransferTimeout time.Duration `yaml:"transfer_timeout"`
+	// how long a replica waits for the primary to confirm an accepted proposal, bounds the whole proposal on the primary
+	ProposalTimeout time.Duration `yaml:"proposal_timeout"`
+
+	// how often a primary starts a replication (or sharding) round
+	ReplicationInterval time.Duration `yaml:"replication_interval"`
+	// files sent per UploadFiles call while replicating, < 1 sends everything at once
+	ReplicationCohortSize int `yaml:"replication_cohort_size"`
+	// bytes per second sent to replicas, 0 is unlimited
+	ReplicationBandwidth int `yaml:"replication_bandwidth"`
+
+	// copies of every file in marriage mode, the primary recruits replication_factor - 1 replicas
+	ReplicationFactor int `yaml:"replication_factor"`
+	// extra replicas recruited for the files replicas with too little budget can't take
+	OverflowReplicas int `yaml:"overflow_replicas"`
+
+	// failure domain (rack, zone) advertised in heartbeats, primaries avoid replicas sharing theirs
+	Zone string `yaml:"zone"`
+	// how a primary picks the peers it proposes to: "scored" weighs free capacity,
+	// load and latency, "capacity", "latency" or "random"
+	PartnerSelection string `yaml:"partner_selection"`
+
+	// "marriage" replicates every file to married replicas, "erasure" spreads
+	// erasure_data_shards + erasure_parity_shards Reed-Solomon shards over distinct peers
+	Redundancy string `yaml:"redundancy"`
+	ErasureDataShards int `yaml:"erasure_data_shards"`
+	// shard holders that may be lost without losing data
+	ErasureParityShards int `yaml:"erasure_parity_shards"`
+
+	// how often a primary reconciles its files and trees with every replica, 0 disables it
+	AntiEntropyInterval time.Duration `yaml:"anti_entropy_interval"`
+
+	// JSON file keeping the node id, role, trees and acknowledged replication
+	// across restarts, "" keeps them in memory only. Every node needs its own
+	// file, the saved role wins over primary.
+	StateFile string `yaml:"state_file"`
+
+	// how often every stored blob is rehashed, 0 disables scrubbing
+	ScrubInterval time.Duration `yaml:"scrub_interval"`
+	// fetch corrupted or missing blobs from the married partner
+	ScrubRepair bool `yaml:"scrub_repair"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Primary: false,
+		Budget: 1000,
+		Port: defaultPort,
+		StorageBackend: "local",
+		StoragePath: ".",
+		StorageShardDepth: 2,
+		StorageFsync: true,
+		S3: S3Config{
+			Prefix: "2gud",
+			Secure: true,
+		},
+		Compression: CompressionNone,
+		WireCompression: true,
+		HeartBeatInterval: 1 * time.Second,
+		DeathThreshold: 60 * time.Second,
+		DeadPeerRetention: 10 * time.Minute,
+		PhiSuspectThreshold: 5,
+		PhiDeathThreshold: 12,
+		PhiMinStdDeviation: 500 * time.Millisecond,
+		PhiAcceptablePause: 10 * time.Second,
+		IndirectProbes: 3,
+		GossipFanout: 3,
+		DiscoveryInterval: 1 * time.Second,
+		DiscoveryMaxInterval: 1 * time.Minute,
+		Peers: []string{},
+		DiscoveryDNS: "",
+		DiscoveryFile: "",
+		DiscoveryMulticast: true,
+		DiscoveryLimit: 0,
+		DiscoveryTimeLimit: 10 * time.Second,
+		CallTimeout: 2 * time.Second,
+		TransferTimeout: 30 * time.Second,
+		ProposalTimeout: 10 * time.Second,
+		ReplicationInterval: 1 * time.Second,
+		ReplicationCohortSize: 50,
+		ReplicationBandwidth: 0,
+		ReplicationFactor: 2,
+		OverflowReplicas: 0,
+		Zone: "",
+		PartnerSelection: SelectionScored,
+		Redundancy: RedundancyMarriage,
+		ErasureDataShards: 4,
+		ErasureParityShards: 2,
+		AntiEntropyInterval: 5 * time.Minute,
+		StateFile: "",
+		ScrubInterval: 1 * time.Hour,
+		ScrubRepair: true,
+	}
+}
+
+// loadConfig reads the optional YAML file at path over the defaults and
+// applies environment overrides on top. Unknown keys in the file are errors.
+func loadConfig(path string) (err error, config *Config) {
+	config = defaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("Error opening config file: %w", err), nil
+		}
+		defer f.Close()
+
+		decoder := yaml.NewDecoder(f)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil {
+			return fmt.Errorf("Error parsing config file %s: %w", path, err), nil
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(config).Elem(), envPrefix); err != nil {
+		return err, nil
+	}
+
+	return nil, config
+}
+
+// applyEnv walks the yaml tags of v and overrides every field that has a matching variable set
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := v.Field(i)
+		name := prefix + "_" + strings.ToUpper(t.Field(i).Tag.Get("yaml"))
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		if err := setField(field, raw); err != nil {
+			return fmt.Errorf("Invalid value %q for %s: %w", raw, name, err)
+		}
+	}
+
+	return nil
+}
+
+func setField(field reflect.Value, raw string) error {
+	if field.Type() == reflect.TypeOf(time.Duration(0)) {
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return err
+			}
+			field.SetBool(b)
+		case reflect.Int:
+			i, err := strconv.Atoi(raw)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(i))
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return err
+			}
+			field.SetFloat(f)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return errors.New("unsupported type " + field.Type().String())
+			}
+			field.Set(reflect.ValueOf(splitList(raw)))
+		default:
+			return errors.New("unsupported type " + field.Type().String())
+	}
+
+	return nil
+}
+
+// splitList splits a comma separated list, dropping empty entries
+func splitList(raw string) []string {
+	values := []string{}
+	for _, value := range strings.Split(raw, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+
+	return values
+}
+
+// validate reports every problem at once rather than the first one
+func (c *Config) validate() error {
+	var errs []error
+
+	if c.Budget < 0 {
+		errs = append(errs, errors.New("budget must not be negative"))
+	}
+
+	if p, err := strconv.Atoi(c.Port); err != nil || p < 1 || p > 65535 {
+		errs = append(errs, fmt.Errorf("port %q is not a valid TCP port", c.Port))
+	}
+
+	switch c.StorageBackend {
+		case "local":
+			if c.StoragePath == "" {
+				errs = append(errs, errors.New("storage_path must not be empty"))
+			}
+		case "s3":
+			if c.S3.Endpoint == "" || c.S3.Bucket == "" {
+				errs = append(errs, errors.New("s3.endpoint and s3.bucket are required by the s3 storage backend"))
+			}
+			// objects live below the node id, a fresh id on every start would orphan them
+			if c.StateFile == "" {
+				errs = append(errs, errors.New("state_file is required by the s3 storage backend"))
+			}
+		case "memory":
+		default:
+			errs = append(errs, fmt.Errorf("storage_backend must be local, s3 or memory, got %q", c.StorageBackend))
+	}
+
+	// a sha256 hex digest has 32 two character shards
+	if c.StorageShardDepth < 0 || c.StorageShardDepth > 32 {
+		errs = append(errs, fmt.Errorf("storage_shard_depth must be between 0 and 32, got %d", c.StorageShardDepth))
+	}
+
+	if c.Compression == "" || !isSupportedCompression(c.Compression) {
+		errs = append(errs, fmt.Errorf("compression must be one of %v, got %q", supportedCompressions, c.Compression))
+	}
+
+	durations := []struct {
+		name string
+		value time.Duration
+	}{
+		{"heartbeat_interval", c.HeartBeatInterval},
+		{"death_threshold", c.DeathThreshold},
+		{"phi_min_std_deviation", c.PhiMinStdDeviation},
+		{"discovery_interval", c.DiscoveryInterval},
+		{"discovery_max_interval", c.DiscoveryMaxInterval},
+		{"discovery_time_limit", c.DiscoveryTimeLimit},
+		{"call_timeout", c.CallTimeout},
+		{"transfer_timeout", c.TransferTimeout},
+		{"proposal_timeout", c.ProposalTimeout},
+		{"replication_interval", c.ReplicationInterval},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", d.name, d.value))
+		}
+	}
+
+	switch c.Redundancy {
+		case RedundancyMarriage:
+			if c.ReplicationFactor < 2 {
+				errs = append(errs, fmt.Errorf("replication_factor must be at least 2, got %d", c.ReplicationFactor))
+			}
+			if c.OverflowReplicas < 0 {
+				errs = append(errs, fmt.Errorf("overflow_replicas must not be negative, got %d", c.OverflowReplicas))
+			}
+		case RedundancyErasure:
+			if c.ErasureDataShards < 1 || c.ErasureParityShards < 1 || c.ErasureDataShards + c.ErasureParityShards > 256 {
+				errs = append(errs, fmt.Errorf("erasure shards need at least 1 data and 1 parity shard and at most 256 in total, got %d+%d", c.ErasureDataShards, c.ErasureParityShards))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("redundancy must be marriage or erasure, got %q", c.Redundancy))
+	}
+
+	if !slices.Contains(partnerSelections, c.PartnerSelection) {
+		errs = append(errs, fmt.Errorf("partner_selection must be one of %v, got %q", partnerSelections, c.PartnerSelection))
+	}
+
+	if c.ReplicationBandwidth < 0 {
+		errs = append(errs, fmt.Errorf("replication_bandwidth must not be negative, got %d", c.ReplicationBandwidth))
+	}
+
+	if c.AntiEntropyInterval < 0 {
+		errs = append(errs, fmt.Errorf("anti_entropy_interval must not be negative, got %s", c.AntiEntropyInterval))
+	}
+
+	if c.DeadPeerRetention < 0 {
+		errs = append(errs, fmt.Errorf("dead_peer_retention must not be negative, got %s", c.DeadPeerRetention))
+	}
+
+	if c.ScrubInterval < 0 {
+		errs = append(errs, fmt.Errorf("scrub_interval must not be negative, got %s", c.ScrubInterval))
+	}
+
+	if c.PhiSuspectThreshold <= 0 || c.PhiDeathThreshold < c.PhiSuspectThreshold {
+		errs = append(errs, fmt.Errorf("phi thresholds need 0 < phi_suspect_threshold <= phi_death_threshold, got %g and %g", c.PhiSuspectThreshold, c.PhiDeathThreshold))
+	}
+
+	if c.PhiAcceptablePause < 0 {
+		errs = append(errs, fmt.Errorf("phi_acceptable_pause must not be negative, got %s", c.PhiAcceptablePause))
+	}
+
+	if c.IndirectProbes < 0 {
+		errs = append(errs, fmt.Errorf("indirect_probes must not be negative, got %d", c.IndirectProbes))
+	}
+
+	// a proposal makes two calls
+	if c.ProposalTimeout < 2 * c.CallTimeout {
+		errs = append(errs, fmt.Errorf("proposal_timeout (%s) must be at least twice call_timeout (%s)", c.ProposalTimeout, c.CallTimeout))
+	}
+
+	if c.DeathThreshold <= c.HeartBeatInterval {
+		errs = append(errs, fmt.Errorf("death_threshold (%s) must be longer than heartbeat_interval (%s)", c.DeathThreshold, c.HeartBeatInterval))
+	}
+
+	tlsSet := c.TLS.Cert != "" || c.TLS.Key != "" || c.TLS.CA != ""
+	if tlsSet && (c.TLS.Cert == "" || c.TLS.Key == "" || c.TLS.CA == "") {
+		errs = append(errs, errors.New("tls.cert, tls.key and tls.ca must be set together"))
+	}
+
+	if c.TLS.Mutual && !tlsSet {
+		errs = append(errs, errors.New("tls.mutual requires tls.cert, tls.key and tls.ca"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// print writes the effective configuration as yaml, with the S3 credentials masked
+func (c *Config) print() error {
+	redacted := *c
+	if redacted.S3.AccessKey != "" {
+		redacted.S3.AccessKey = redactedSecret
+	}
+	if redacted.S3.SecretKey != "" {
+		redacted.S3.SecretKey = redactedSecret
+	}
+
+	encoder := yaml.NewEncoder(os.Stdout)
+	defer encoder.Close()
+
+	return encoder.Encode(&redacted)
+}
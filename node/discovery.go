@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/schollz/peerdiscovery"
+)
+
+// Discoverer finds addresses peers may listen on, every address not seen
+// before gets a first heartbeat
+type Discoverer interface {
+	Name() string
+	Discover(ctx context.Context) (err error, peers []DiscoveredPeer)
+}
+
+// DiscoveredPeer is where a peer may listen, backends that know it also tell its id and role
+type DiscoveredPeer struct {
+	Address string
+	ID string
+	IsPrimary bool
+}
+
+// discoveryPayload is broadcast by multicast discovery, it has to stay short
+type discoveryPayload struct {
+	ID string `json:"id"`
+	Address string `json:"address"`
+	Primary bool `json:"primary"`
+}
+
+func (n *Node) discoveryPayload() []byte {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	payload, _ := json.Marshal(discoveryPayload{
+		ID: n.id,
+		Address: n.address,
+		Primary: n.isPrimary,
+	})
+
+	return payload
+}
+
+func addressesOnly(addresses []string) []DiscoveredPeer {
+	peers := make([]DiscoveredPeer, 0, len(addresses))
+	for _, address := range addresses {
+		peers = append(peers, DiscoveredPeer{Address: address})
+	}
+
+	return peers
+}
+
+// newDiscoverers builds every discovery backend enabled by config, multicast last as it blocks for discovery_time_limit
+func newDiscoverers(config *Config, self string, payload func() []byte) []Discoverer {
+	var discoverers []Discoverer
+
+	if len(config.Peers) > 0 {
+		discoverers = append(discoverers, &staticDiscoverer{peers: config.Peers})
+	}
+	if config.DiscoveryDNS != "" {
+		discoverers = append(discoverers, &dnsDiscoverer{name: config.DiscoveryDNS})
+	}
+	if config.DiscoveryFile != "" {
+		discoverers = append(discoverers, &fileDiscoverer{path: config.DiscoveryFile})
+	}
+	if config.DiscoveryMulticast {
+		discoverers = append(discoverers, &multicastDiscoverer{config: config, self: self, payload: payload})
+	}
+
+	return discoverers
+}
+
+// staticDiscoverer hands out the seed list given with --peers
+type staticDiscoverer struct {
+	peers []string
+}
+
+func (d *staticDiscoverer) Name() string {
+	return "static"
+}
+
+func (d *staticDiscoverer) Discover(ctx context.Context) (err error, peers []DiscoveredPeer) {
+	for _, peer := range d.peers {
+		peers = append(peers, DiscoveredPeer{Address: withDefaultPort(peer)})
+	}
+
+	return nil, peers
+}
+
+// dnsDiscoverer resolves an SRV record (a name starting with '_', e.g.
+// _2gud._tcp.nodes.svc.cluster.local) or the A/AAAA records of a host[:port]
+type dnsDiscoverer struct {
+	name string
+}
+
+func (d *dnsDiscoverer) Name() string {
+	return "dns"
+}
+
+func (d *dnsDiscoverer) Discover(ctx context.Context) (err error, peers []DiscoveredPeer) {
+	var addresses []string
+
+	if strings.HasPrefix(d.name, "_") {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", d.name)
+		if err != nil {
+			return err, nil
+		}
+
+		for _, srv := range records {
+			addresses = append(addresses, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+
+		return nil, addressesOnly(addresses)
+	}
+
+	host, port, err := net.SplitHostPort(d.name)
+	if err != nil {
+		host, port = d.name, defaultPort
+	}
+
+	ips, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return err, nil
+	}
+
+	for _, ip := range ips {
+		addresses = append(addresses, net.JoinHostPort(ip, port))
+	}
+
+	return nil, addressesOnly(addresses)
+}
+
+// fileDiscoverer reads one host[:port] per line, blank lines and lines
+// starting with '#' are skipped. The file is only read again once it changed.
+type fileDiscoverer struct {
+	path string
+	modTime time.Time
+	size int64
+	addresses []string
+}
+
+func (d *fileDiscoverer) Name() string {
+	return "file"
+}
+
+func (d *fileDiscoverer) Discover(ctx context.Context) (err error, peers []DiscoveredPeer) {
+	info, err := os.Stat(d.path)
+	if err != nil {
+		return err, nil
+	}
+
+	if info.ModTime().Equal(d.modTime) && info.Size() == d.size {
+		return nil, addressesOnly(d.addresses)
+	}
+
+	var addresses []string
+
+	f, err := os.Open(d.path)
+	if err != nil {
+		return err, nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addresses = append(addresses, withDefaultPort(line))
+	}
+	if err := scanner.Err(); err != nil {
+		return err, nil
+	}
+
+	fmt.Printf("Read %d peers from %s\n", len(addresses), d.path)
+	d.modTime, d.size, d.addresses = info.ModTime(), info.Size(), addresses
+
+	return nil, addressesOnly(addresses)
+}
+
+// multicastDiscoverer listens for peerdiscovery broadcasts on the local network
+// while broadcasting the id, address and role of this node
+type multicastDiscoverer struct {
+	config *Config
+	self string
+	payload func() []byte
+}
+
+func (d *multicastDiscoverer) Name() string {
+	return "multicast"
+}
+
+func (d *multicastDiscoverer) Discover(ctx context.Context) (err error, peers []DiscoveredPeer) {
+	// a shutdown ends the discovery window early
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+			case <-ctx.Done():
+				close(stop)
+			case <-done:
+		}
+	}()
+
+	settings := peerdiscovery.Settings{
+		Limit: d.config.DiscoveryLimit,
+		TimeLimit: d.config.DiscoveryTimeLimit,
+		// roles change, the payload is rebuilt for every broadcast
+		PayloadFunc: d.payload,
+		// several nodes may share one host on different ports
+		AllowSelf: true,
+		StopChan: stop,
+	}
+
+	if host, _, _ := net.SplitHostPort(d.self); net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+		settings.IPVersion = peerdiscovery.IPv6
+	}
+
+	discoveries, err := peerdiscovery.Discover(settings)
+	if err != nil {
+		return err, nil
+	}
+
+	for _, discovery := range discoveries {
+		var payload discoveryPayload
+		if err := json.Unmarshal(discovery.Payload, &payload); err == nil && payload.Address != "" {
+			peers = append(peers, DiscoveredPeer{
+				Address: payload.Address,
+				ID: payload.ID,
+				IsPrimary: payload.Primary,
+			})
+			continue
+		}
+
+		// older nodes broadcast their bare address or, older still, nothing and listen on the default port
+		address := string(discovery.Payload)
+		if address == "" {
+			address = withDefaultPort(discovery.Address)
+		}
+		peers = append(peers, DiscoveredPeer{Address: address})
+	}
+
+	return nil, peers
+}
+
+// runDiscovery discovers peers until ctx is cancelled. As long as rounds fail
+// or the peer table stops growing they back off exponentially up to discovery_max_interval.
+func (n *Node) runDiscovery(ctx context.Context) {
+	wait := n.config.DiscoveryInterval
+	known := -1
+
+	for {
+		// first heartbeats of the previous round had their time to answer
+		n.lock.Lock()
+		grown := len(n.peerTable) > known
+		known = len(n.peerTable)
+		n.lock.Unlock()
+
+		err := n.discoverNewPeers(ctx)
+		if err == nil && grown {
+			wait = n.config.DiscoveryInterval
+		} else {
+			wait = min(2 * wait, n.config.DiscoveryMaxInterval)
+		}
+
+		select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+		}
+	}
+}
+
+// discoverNewPeers asks every discovery backend for peers and sends a first
+// heartbeat to the new ones. Peers already known by id are skipped, an address
+// that doesn't answer is tried again next round.
+func (n *Node) discoverNewPeers(ctx context.Context) error {
+	n.lock.Lock()
+	n.expireAddresses()
+	n.lock.Unlock()
+
+	var errs []error
+	for _, discoverer := range n.discoverers {
+		err, peers := discoverer.Discover(ctx)
+		if err != nil {
+			fmt.Printf("%s discovery failed: %s\n", discoverer.Name(), err)
+			errs = append(errs, err)
+			continue
+		}
+
+		for _, p := range peers {
+			if p.Address == n.address || p.ID == n.id || !n.discovered(p) {
+				continue
+			}
+
+			fmt.Printf("Discovered new peer through %s: %s\n", discoverer.Name(), p.Address)
+			n.spawn("first heartbeat", func() {
+				if err := n.sendFirstHeartBeat(ctx, p.Address); err != nil {
+					n.lock.Lock()
+					delete(n.discoveredAddresses, p.Address)
+					n.lock.Unlock()
+				}
+			})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// discovered records p, false if it is known already by id or address
+func (n *Node) discovered(p DiscoveredPeer) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if known, ok := n.peerTable[p.ID]; ok && p.ID != "" {
+		if state, _ := known.status(); state != PeerDead {
+			return false
+		}
+	}
+
+	if _, ok := n.discoveredAddresses[p.Address]; ok {
+		return false
+	}
+
+	n.discoveredAddresses[p.Address] = time.Now()
+
+	return true
+}
+
+// expireAddresses forgets the addresses no live peer answered on for
+// death_threshold, so they are discovered again once someone is back there.
+// Callers hold n.lock.
+func (n *Node) expireAddresses() {
+	now := time.Now()
+
+	live := make(map[string]bool)
+	for _, peer := range n.peerTable {
+		if state, _ := peer.status(); state != PeerDead {
+			live[peer.address] = true
+		}
+	}
+
+	for address, seen := range n.discoveredAddresses {
+		if live[address] {
+			n.discoveredAddresses[address] = now
+			continue
+		}
+
+		if now.Sub(seen) > n.config.DeathThreshold {
+			fmt.Printf("Forgetting %s, nobody answered there for %s\n", address, n.config.DeathThreshold)
+			delete(n.discoveredAddresses, address)
+		}
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	RedundancyMarriage = "marriage"
+	RedundancyErasure = "erasure"
+)
+
+type ShardLocation struct {
+	Index int
+	Hash string
+	NodeID string
+	Address string
+}
+
+// ShardPlacement records where the k+m Reed-Solomon shards of one committed file live
+type ShardPlacement struct {
+	Size int
+	DataShards int
+	ParityShards int
+	Shards []ShardLocation
+}
+
+// shardFiles erasure codes every committed but unprotected file and spreads
+// the shards over distinct peers. It is the erasure mode counterpart of replicateFiles.
+func (n *Node) shardFiles(ctx context.Context) error {
+	// ticks may overlap with a slow round, which then shards alone
+	if !n.replicationState.start() {
+		return nil
+	}
+	defer n.replicationState.finish()
+
+	n.lock.Lock()
+	var pendingFiles []string
+	for hash, status := range n.fileStatusTable {
+		if status == 1 {
+			pendingFiles = append(pendingFiles, hash)
+		}
+	}
+
+	var holders []string
+	addresses := make(map[string]string)
+	for id, peer := range n.peerTable {
+		if peer.alive() {
+			holders = append(holders, id)
+			addresses[id] = peer.address
+		}
+	}
+	n.lock.Unlock()
+
+	if len(pendingFiles) == 0 {
+		return nil
+	}
+
+	width := n.config.ErasureDataShards + n.config.ErasureParityShards
+
+	if len(holders) < width {
+		fmt.Printf("Only %d of %d shard holders available, cannot ensure redundancy\n", len(holders), width)
+		return nil
+	}
+
+	// spread the load, every file starts at a different holder
+	sort.Strings(holders)
+
+	var sharded []string
+	for i, fileHash := range pendingFiles {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		chosen := make([]string, width)
+		for j := range chosen {
+			chosen[j] = holders[(i + j) % len(holders)]
+		}
+
+		err, placement := n.shardFile(ctx, fileHash, chosen, addresses)
+		if err != nil {
+			fmt.Printf("Sharding %s failed: %s\n", fileHash, err)
+			continue
+		}
+
+		n.lock.Lock()
+		n.shardPlacements[fileHash] = placement
+		n.fileStatusTable[fileHash] = 2
+		n.lock.Unlock()
+		sharded = append(sharded, fileHash)
+	}
+
+	if len(sharded) == 0 {
+		return nil
+	}
+
+	// the placements must be on disk before the full copies go away
+	if err := n.saveState(); err != nil {
+		return err
+	}
+
+	// every shard is acknowledged, the full copy would only double the storage
+	for _, fileHash := range sharded {
+		if err := n.store.Delete(fileHash); err != nil {
+			fmt.Printf("Could not drop the full copy of %s: %s\n", fileHash, err)
+			continue
+		}
+
+		n.lock.Lock()
+		delete(n.fileCodecs, fileHash)
+		n.fileBudget++
+		n.lock.Unlock()
+	}
+
+	n.saveState()
+
+	return nil
+}
+
+func (n *Node) shardFile(ctx context.Context, fileHash string, holders []string, addresses map[string]string) (err error, placement *ShardPlacement) {
+	err, content := n.readBlob(fileHash)
+	if err != nil {
+		return err, nil
+	}
+
+	if ComputeHash(string(content)) != fileHash {
+		return errors.New("Local copy is corrupted"), nil
+	}
+
+	enc, err := reedsolomon.New(n.config.ErasureDataShards, n.config.ErasureParityShards)
+	if err != nil {
+		return err, nil
+	}
+
+	shards, err := enc.Split(content)
+	if err != nil {
+		return err, nil
+	}
+
+	if err := enc.Encode(shards); err != nil {
+		return err, nil
+	}
+
+	// every holder keeps the trees of the file too, the index must not live on the primary alone
+	n.lock.Lock()
+	trees := make(map[string]map[string]int)
+	for root, t := range n.trees {
+		if _, ok := t.hashToIndex[fileHash]; ok {
+			trees[root] = t.hashToIndex
+		}
+	}
+	n.lock.Unlock()
+
+	// the whole placement is known up front and travels with every shard
+	placement = &ShardPlacement{
+		Size: len(content),
+		DataShards: n.config.ErasureDataShards,
+		ParityShards: n.config.ErasureParityShards,
+	}
+	for i, shard := range shards {
+		placement.Shards = append(placement.Shards, ShardLocation{
+			Index: i,
+			Hash: ComputeHash(string(shard)),
+			NodeID: holders[i],
+			Address: addresses[holders[i]],
+		})
+	}
+
+	// a placement is all or nothing, what the holders got so far is dropped again
+	var booked []ShardLocation
+	defer func() {
+		if err != nil {
+			n.dropShards(ctx, fileHash, booked)
+		}
+	}()
+
+	for i, location := range placement.Shards {
+		// shards are booked like any other upload
+		err, granted := n.bookReplica(ctx, location.Address, 1, "")
+		if err != nil {
+			// the booking may have gone through all the same
+			booked = append(booked, location)
+			return fmt.Errorf("booking shard %d on %s: %w", i, location.NodeID, err), nil
+		}
+		if granted == 0 {
+			return fmt.Errorf("%s has no budget left for shard %d", location.NodeID, i), nil
+		}
+		booked = append(booked, location)
+
+		args := StoreShardArgs{
+			RequesterID: n.id,
+			FileHash: fileHash,
+			Index: i,
+			Content: string(shards[i]),
+			Placement: placement,
+			Trees: trees,
+		}
+		var reply StoreShardReply
+
+		callCtx, cancel := context.WithTimeout(ctx, n.config.TransferTimeout)
+		err = call(callCtx, location.Address, "Node.StoreShard", &args, &reply)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("storing shard %d on %s: %w", i, location.NodeID, err), nil
+		}
+		if reply.Hash != location.Hash {
+			return fmt.Errorf("%s acknowledged the wrong shard %d", location.NodeID, i), nil
+		}
+	}
+
+	return nil, placement
+}
+
+// dropShards rolls back the shards of a failed placement, or the bookings made for them
+func (n *Node) dropShards(ctx context.Context, fileHash string, locations []ShardLocation) {
+	for _, location := range locations {
+		args := DropShardArgs{
+			RequesterID: n.id,
+			FileHash: fileHash,
+			Index: location.Index,
+		}
+		var reply DropShardReply
+
+		callCtx, cancel := context.WithTimeout(ctx, n.config.CallTimeout)
+		err := call(callCtx, location.Address, "Node.DropShard", &args, &reply)
+		cancel()
+		if err != nil {
+			fmt.Printf("Could not drop shard %d of %s on %s: %s\n", location.Index, fileHash, location.NodeID, err)
+		}
+	}
+}
+
+// reconstructFromShards rebuilds a file from any k intact shards and verifies it against its leaf hash
+func (n *Node) reconstructFromShards(ctx context.Context, fileHash string) (err error, content []byte) {
+	// placements are never changed once stored
+	n.lock.Lock()
+	placement, ok := n.shardPlacements[fileHash]
+	n.lock.Unlock()
+	if !ok {
+		err, placement = n.findPlacement(ctx, fileHash)
+		if err != nil {
+			return err, nil
+		}
+	}
+
+	shards := make([][]byte, len(placement.Shards))
+	found := 0
+	for _, location := range placement.Shards {
+		if found == placement.DataShards {
+			break
+		}
+
+		args := FetchShardArgs{
+			RequesterID: n.id,
+			Hash: location.Hash,
+		}
+		var reply FetchShardReply
+
+		callCtx, cancel := context.WithTimeout(ctx, n.config.TransferTimeout)
+		err := call(callCtx, location.Address, "Node.FetchShard", &args, &reply)
+		cancel()
+
+		// a dead holder or a rotten shard is just another erasure
+		if err != nil || ComputeHash(reply.Content) != location.Hash {
+			fmt.Printf("Shard %d of %s unavailable on %s\n", location.Index, fileHash, location.NodeID)
+			continue
+		}
+
+		shards[location.Index] = []byte(reply.Content)
+		found++
+	}
+
+	if found < placement.DataShards {
+		return fmt.Errorf("Only %d of %d required shards of %s are available", found, placement.DataShards, fileHash), nil
+	}
+
+	enc, err := reedsolomon.New(placement.DataShards, placement.ParityShards)
+	if err != nil {
+		return err, nil
+	}
+
+	if err := enc.ReconstructData(shards); err != nil {
+		return err, nil
+	}
+
+	var buf bytes.Buffer
+	if err := enc.Join(&buf, shards, placement.Size); err != nil {
+		return err, nil
+	}
+
+	if ComputeHash(buf.String()) != fileHash {
+		return errors.New("Reconstructed file does not match its leaf hash"), nil
+	}
+
+	return nil, buf.Bytes()
+}
+
+// findPlacement asks the live peers where the shards of a file live, so
+// nodes that never held one of them can rebuild the file too
+func (n *Node) findPlacement(ctx context.Context, fileHash string) (err error, placement *ShardPlacement) {
+	n.lock.Lock()
+	var addresses []string
+	for _, peer := range n.peerTable {
+		if peer.alive() {
+			addresses = append(addresses, peer.address)
+		}
+	}
+	n.lock.Unlock()
+
+	for _, address := range addresses {
+		args := FetchPlacementArgs{
+			RequesterID: n.id,
+			FileHash: fileHash,
+		}
+		var reply FetchPlacementReply
+
+		callCtx, cancel := context.WithTimeout(ctx, n.config.CallTimeout)
+		err := call(callCtx, address, "Node.FetchPlacement", &args, &reply)
+		cancel()
+		if err != nil || reply.Placement == nil {
+			continue
+		}
+
+		n.lock.Lock()
+		n.shardPlacements[fileHash] = reply.Placement
+		n.lock.Unlock()
+
+		return nil, reply.Placement
+	}
+
+	return errors.New("No shards recorded for " + fileHash), nil
+}
+
+// isSharded reports whether hash is erasure coded, its full copy is dropped then.
+// Holders only know the placement, the primary also waits for every shard.
+// Called with n.lock held.
+func (n *Node) isSharded(hash string) bool {
+	_, ok := n.shardPlacements[hash]
+	return ok && n.fileStatusTable[hash] != 1
+}
+
+// recoverBlob fetches a good copy of hash from wherever the configured redundancy mode put it
+func (n *Node) recoverBlob(ctx context.Context, hash string) (err error, content []byte) {
+	n.lock.Lock()
+	_, sharded := n.shardPlacements[hash]
+	n.lock.Unlock()
+
+	if sharded || n.config.Redundancy == RedundancyErasure {
+		return n.reconstructFromShards(ctx, hash)
+	}
+
+	err, partnerContent := n.fetchFromPartner(ctx, hash)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, []byte(partnerContent)
+}
+
+// StoreShard keeps one erasure coded shard on behalf of a primary, every
+// shard takes one file of a booking made through UploadRequest
+func (n *Node) StoreShard(args *StoreShardArgs, reply *StoreShardReply) error {
+	hash := ComputeHash(args.Content)
+	placement := args.Placement
+	if placement == nil || args.Index < 0 || args.Index >= len(placement.Shards) || placement.Shards[args.Index].Hash != hash {
+		return errors.New("Shard does not match its placement")
+	}
+
+	trees := make(map[string]*MerkleTree)
+	for root, indexMap := range args.Trees {
+		err, t := treeFromIndexMap(indexMap)
+		if err != nil || t.root.hash != root {
+			return errors.New("Tree does not match its root")
+		}
+		trees[root] = t
+	}
+
+	n.lock.Lock()
+	if n.fileBookings[args.RequesterID] < 1 {
+		n.lock.Unlock()
+		return errors.New("no bookings made!")
+	}
+
+	// reserved up front, concurrent shards must not overdraw the booking
+	n.fileBookings[args.RequesterID]--
+	codec := n.bookingCompression[args.RequesterID]
+	if n.fileBookings[args.RequesterID] == 0 {
+		delete(n.fileBookings, args.RequesterID)
+		delete(n.bookingCompression, args.RequesterID)
+	}
+	n.lock.Unlock()
+
+	stored := false
+	if err, ok := n.store.Has(hash); err == nil && ok {
+		stored = true
+	} else if err := n.writeBlob(hash, []byte(args.Content), codec); err != nil {
+		fmt.Printf("Error storing shard %s: %s\n", hash, err)
+		n.lock.Lock()
+		n.fileBudget++
+		n.lock.Unlock()
+		return errors.New("Error storing shard")
+	}
+
+	n.lock.Lock()
+	// a shard already held takes no extra room
+	if stored {
+		n.fileBudget++
+	}
+	n.shardPlacements[args.FileHash] = placement
+	for root, t := range trees {
+		if _, ok := n.trees[root]; !ok {
+			n.trees[root] = t
+			n.treesStatus[root] = 0
+		}
+	}
+	n.lock.Unlock()
+	n.saveState()
+
+	reply.Hash = hash
+
+	return nil
+}
+
+// DropShard rolls back a shard of a placement that failed on another holder.
+// A shard that never arrived gives back its booking instead.
+func (n *Node) DropShard(args *DropShardArgs, reply *DropShardReply) error {
+	n.lock.Lock()
+	placement, ok := n.shardPlacements[args.FileHash]
+	if !ok {
+		if n.fileBookings[args.RequesterID] > 0 {
+			n.fileBookings[args.RequesterID]--
+			n.fileBudget++
+			if n.fileBookings[args.RequesterID] == 0 {
+				delete(n.fileBookings, args.RequesterID)
+				delete(n.bookingCompression, args.RequesterID)
+			}
+		}
+		n.lock.Unlock()
+		return nil
+	}
+
+	if args.Index < 0 || args.Index >= len(placement.Shards) {
+		n.lock.Unlock()
+		return errors.New("Shard does not match its placement")
+	}
+
+	hash := placement.Shards[args.Index].Hash
+	delete(n.shardPlacements, args.FileHash)
+	delete(n.fileCodecs, hash)
+	n.lock.Unlock()
+
+	if err := n.store.Delete(hash); err != nil {
+		fmt.Printf("Error dropping shard %s: %s\n", hash, err)
+		return errors.New("Error dropping shard")
+	}
+
+	n.lock.Lock()
+	n.fileBudget++
+	n.lock.Unlock()
+	n.saveState()
+
+	return nil
+}
+
+// FetchPlacement tells any node rebuilding a file where its shards live
+func (n *Node) FetchPlacement(args *FetchPlacementArgs, reply *FetchPlacementReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	placement, ok := n.shardPlacements[args.FileHash]
+	if !ok {
+		return errors.New("No shards recorded for " + args.FileHash)
+	}
+
+	reply.Placement = placement
+
+	return nil
+}
+
+// FetchShard hands out a shard stored through StoreShard
+func (n *Node) FetchShard(args *FetchShardArgs, reply *FetchShardReply) error {
+	err, content := n.readBlob(args.Hash)
+	if errors.Is(err, ErrBlobNotFound) {
+		return errors.New("Shard is missing on this node")
+	} else if err != nil {
+		fmt.Printf("Error reading shard: %s\n", err)
+		return errors.New("Error reading shard")
+	}
+
+	if ComputeHash(string(content)) != args.Hash {
+		return errors.New("Shard corrupted on this node")
+	}
+
+	reply.Content = string(content)
+
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func erasureCoded(c *Config) {
+	c.Redundancy = RedundancyErasure
+	c.ErasureDataShards = 2
+	c.ErasureParityShards = 1
+}
+
+func TestShardedFilesAreRebuiltAnywhere(t *testing.T) {
+	ctx := context.Background()
+
+	primary := startNode(t, true, erasureCoded)
+	holders := []*Node{startNode(t, false, nil), startNode(t, false, nil), startNode(t, false, nil)}
+	introduce(t, ctx, append([]*Node{primary}, holders...)...)
+
+	// the outsider holds no shard and never heard of the file
+	outsider := startNode(t, false, nil)
+	for _, holder := range holders {
+		if err := outsider.sendFirstHeartBeat(ctx, holder.address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	content := strings.Repeat("erasure coded ", 100)
+	hash := ComputeHash(content)
+	if err := upload(primary, "client", CompressionNone, map[string]string{hash: content}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primary.shardFiles(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.lock.Lock()
+	status, budget := primary.fileStatusTable[hash], primary.fileBudget
+	var root string
+	for r := range primary.trees {
+		root = r
+	}
+	primary.lock.Unlock()
+	if status != 2 {
+		t.Fatalf("file status is %d after sharding, want 2", status)
+	}
+
+	// the full copy is dropped and its budget given back
+	if err, ok := primary.store.Has(hash); err != nil || ok {
+		t.Fatalf("primary still holds the full copy: %v, %v", ok, err)
+	}
+	if budget != primary.config.Budget {
+		t.Fatalf("primary budget is %d, want %d", budget, primary.config.Budget)
+	}
+
+	for _, holder := range holders {
+		holder.lock.Lock()
+		_, placed := holder.shardPlacements[hash]
+		bookings := len(holder.fileBookings)
+		budget := holder.fileBudget
+		holder.lock.Unlock()
+
+		if !placed {
+			t.Fatalf("holder %s has no placement", holder.id)
+		}
+		if bookings != 0 || budget != holder.config.Budget - 1 {
+			t.Fatalf("holder %s has %d bookings and %d budget left", holder.id, bookings, budget)
+		}
+	}
+
+	err, rebuilt := outsider.reconstructFromShards(ctx, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(rebuilt) != content {
+		t.Fatal("outsider rebuilt the wrong content")
+	}
+
+	// the primary and every holder know the tree, none stores the full copy to serve it
+	for _, n := range append([]*Node{primary}, holders...) {
+		var reply DownloadFileReply
+		if err := n.DownloadFile(&DownloadFileArgs{Merkle: root, Index: 0}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply.Content != content {
+			t.Fatalf("%s served the wrong content", n.id)
+		}
+		if err, ok := n.store.Has(hash); err != nil || ok {
+			t.Fatalf("serving the file stored the full copy again on %s", n.id)
+		}
+	}
+}
+
+func TestFailedShardingIsRolledBack(t *testing.T) {
+	ctx := context.Background()
+
+	primary := startNode(t, true, erasureCoded)
+	var holders []*Node
+	listeners := make(map[*Node]net.Listener)
+	for i := 0; i < 3; i++ {
+		holder, listener := startListeningNode(t, false, nil)
+		holders = append(holders, holder)
+		listeners[holder] = listener
+	}
+	introduce(t, ctx, append([]*Node{primary}, holders...)...)
+
+	// holders are used in id order, the last one fails after the others stored their shards
+	sort.Slice(holders, func(i, j int) bool { return holders[i].id < holders[j].id })
+	listeners[holders[2]].Close()
+
+	content := strings.Repeat("half sharded ", 100)
+	hash := ComputeHash(content)
+	if err := upload(primary, "client", CompressionNone, map[string]string{hash: content}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primary.shardFiles(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	primary.lock.Lock()
+	status := primary.fileStatusTable[hash]
+	_, placed := primary.shardPlacements[hash]
+	primary.lock.Unlock()
+	if status != 1 || placed {
+		t.Fatalf("half sharded file has status %d and placement %t", status, placed)
+	}
+	if err, ok := primary.store.Has(hash); err != nil || !ok {
+		t.Fatal("primary dropped the full copy of a half sharded file")
+	}
+
+	for _, holder := range holders[:2] {
+		err, blobs := holder.store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		holder.lock.Lock()
+		_, placed := holder.shardPlacements[hash]
+		bookings, budget := len(holder.fileBookings), holder.fileBudget
+		holder.lock.Unlock()
+
+		if placed || len(blobs) != 0 || bookings != 0 || budget != holder.config.Budget {
+			t.Fatalf("holder %s kept placement %t, %d shards, %d bookings and %d budget", holder.id, placed, len(blobs), bookings, budget)
+		}
+	}
+}
+
+func TestStoreShardNeedsABooking(t *testing.T) {
+	holder := startNode(t, false, nil)
+
+	shard := "lonely shard"
+	args := StoreShardArgs{
+		RequesterID: "primary",
+		FileHash: ComputeHash("some file"),
+		Content: shard,
+		Placement: &ShardPlacement{
+			DataShards: 1,
+			ParityShards: 1,
+			Shards: []ShardLocation{{Index: 0, Hash: ComputeHash(shard), NodeID: holder.id}},
+		},
+	}
+	var reply StoreShardReply
+	if err := holder.StoreShard(&args, &reply); err == nil {
+		t.Fatal("shard was stored without a booking")
+	}
+
+	var booking UploadRequestReply
+	if err := holder.UploadRequest(&UploadRequestArgs{RequesterID: "primary", RequiredBudget: 1}, &booking); err != nil || !booking.Granted {
+		t.Fatalf("booking failed: %v", err)
+	}
+	if err := holder.StoreShard(&args, &reply); err != nil {
+		t.Fatal(err)
+	}
+
+	// the booking is used up
+	if err := holder.StoreShard(&args, &reply); err == nil {
+		t.Fatal("a single booking stored two shards")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	EventPromoted = "promoted"
+	EventMarried = "married"
+	EventPartnerDied = "partner_died"
+)
+
+// events kept for clients polling Node.Events
+const maxEvents = 1000
+
+// eventLog is a bounded, sequenced log of role and marriage changes
+type eventLog struct {
+	lock sync.Mutex
+
+	next int
+	events []Event
+}
+
+func (l *eventLog) append(kind string, nodeID string, detail string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.events = append(l.events, Event{
+		Seq: l.next,
+		Time: time.Now(),
+		Kind: kind,
+		NodeID: nodeID,
+		Detail: detail,
+	})
+	l.next++
+
+	if len(l.events) > maxEvents {
+		l.events = l.events[len(l.events) - maxEvents:]
+	}
+}
+
+func (n *Node) emit(kind string, detail string) {
+	fmt.Printf("Event %s: %s\n", kind, detail)
+	n.eventLog.append(kind, n.id, detail)
+}
+
+// Events returns the events numbered args.Since and later
+func (n *Node) Events(args *EventsArgs, reply *EventsReply) error {
+	l := &n.eventLog
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	for _, e := range l.events {
+		if e.Seq >= args.Since {
+			reply.Events = append(reply.Events, e)
+		}
+	}
+	reply.Next = l.next
+
+	return nil
+}
+
+// promote makes a replica whose primary died the primary of everything it holds.
+// All held files become committed and unreplicated, trees are rebuilt from their
+// leaves and everything goes to the replicas checkHeartBeats recruits next.
+func (n *Node) promote(deadPrimary string) {
+	n.marriageLock.Lock()
+	defer n.marriageLock.Unlock()
+
+	n.lock.Lock()
+	// a divorce or another promotion got here first
+	if n.isPrimary || n.marriedTo != deadPrimary {
+		n.lock.Unlock()
+		return
+	}
+
+	n.isPrimary = true
+	n.maritalStatus = false
+	n.marriedTo = ""
+	n.proposalID = ""
+	// fences the dead primary should it come back
+	n.term++
+	n.replicas = make(map[string]*replicaState)
+
+	// the dead primary will never commit its booking
+	if left, ok := n.fileBookings[deadPrimary]; ok {
+		if left > 0 {
+			n.fileBudget += left
+		}
+		delete(n.fileBookings, deadPrimary)
+		delete(n.bookingCompression, deadPrimary)
+	}
+
+	// uploads the primary never got to commit are kept as well
+	for hash := range n.fileStatusTable {
+		n.fileStatusTable[hash] = 1
+	}
+	n.fileOwners = make(map[string]string)
+
+	for root, t := range n.trees {
+		err, rebuilt := treeFromIndexMap(t.hashToIndex)
+		if err != nil || rebuilt.root.hash != root {
+			fmt.Printf("Dropping broken tree %s\n", root)
+			delete(n.trees, root)
+			delete(n.treesStatus, root)
+			continue
+		}
+
+		missing := 0
+		for hash := range rebuilt.hashToIndex {
+			if _, ok := n.fileStatusTable[hash]; !ok {
+				missing++
+			}
+		}
+		if missing > 0 {
+			fmt.Printf("Tree %s lacks %d of its %d files, they were never replicated here\n", root, missing, len(rebuilt.hashToIndex))
+		}
+
+		n.trees[root] = rebuilt
+		n.treesStatus[root] = 0
+	}
+
+	detail := fmt.Sprintf("primary %s died, now primary of %d files and %d trees in term %d", deadPrimary, len(n.fileStatusTable), len(n.trees), n.term)
+	n.lock.Unlock()
+
+	n.emit(EventPromoted, detail)
+
+	n.saveState()
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	PeerAlive = "alive"
+	PeerSuspect = "suspect"
+	PeerDead = "dead"
+)
+
+// heartbeat intervals the detector remembers per peer
+const phiWindow = 100
+
+// phiDetector is a phi accrual failure detector (Hayashibara et al.). Instead
+// of a fixed timeout it tells how unlikely the current silence of a peer is,
+// given the intervals its heartbeats arrived at so far.
+type phiDetector struct {
+	intervals []time.Duration
+	next int
+	last time.Time
+}
+
+func (d *phiDetector) heartbeat(now time.Time) {
+	if !d.last.IsZero() {
+		interval := now.Sub(d.last)
+		if len(d.intervals) < phiWindow {
+			d.intervals = append(d.intervals, interval)
+		} else {
+			d.intervals[d.next] = interval
+			d.next = (d.next + 1) % phiWindow
+		}
+	}
+
+	d.last = now
+}
+
+// phi is -log10 of the probability that a heartbeat still arrives after the
+// silence so far. Without samples the expected interval is used as the mean.
+func (d *phiDetector) phi(now time.Time, expected time.Duration, minStd time.Duration, pause time.Duration) float64 {
+	mean, std := float64(expected), float64(expected) / 4
+	if len(d.intervals) > 0 {
+		var sum, squares float64
+		for _, interval := range d.intervals {
+			sum += float64(interval)
+			squares += float64(interval) * float64(interval)
+		}
+		mean = sum / float64(len(d.intervals))
+		std = math.Sqrt(math.Max(squares / float64(len(d.intervals)) - mean * mean, 0))
+	}
+
+	mean += float64(pause)
+	std = math.Max(std, float64(minStd))
+
+	// logistic approximation of the normal distribution, as used by Akka and Cassandra
+	y := (float64(now.Sub(d.last)) - mean) / std
+	e := math.Exp(-y * (1.5976 + 0.070566 * y * y))
+	if float64(now.Sub(d.last)) > mean {
+		return -math.Log10(e / (1 + e))
+	}
+
+	return -math.Log10(1 - 1 / (1 + e))
+}
+
+func newPeer(address string) *Peer {
+	p := &Peer{
+		address: address,
+		state: PeerAlive,
+	}
+	p.heard(time.Now())
+
+	return p
+}
+
+// heard records a heartbeat from the peer
+func (p *Peer) heard(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.lastHeartBeat = now
+	p.detector.heartbeat(now)
+	if p.state != PeerAlive {
+		fmt.Printf("Peer %s is alive again\n", p.address)
+	}
+	p.state = PeerAlive
+}
+
+// reached refutes a suspicion without counting as a heartbeat interval
+func (p *Peer) reached(now time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.lastHeartBeat = now
+	p.detector.last = now
+	p.state = PeerAlive
+}
+
+// learn records what the peer told about itself in a heartbeat
+func (p *Peer) learn(isPrimary bool, maritalStatus bool, compressions []string, incarnation uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.isPrimary = isPrimary
+	p.maritalStatus = maritalStatus
+	p.compressions = compressions
+	p.incarnation = max(p.incarnation, incarnation)
+}
+
+func (p *Peer) role() (isPrimary bool, maritalStatus bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.isPrimary, p.maritalStatus
+}
+
+func (p *Peer) codecs() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.compressions
+}
+
+func (p *Peer) alive() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.state == PeerAlive
+}
+
+func (p *Peer) status() (state string, lastHeartBeat time.Time) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.state, p.lastHeartBeat
+}
+
+// deadFor is how long the peer has been dead, 0 unless it is
+func (p *Peer) deadFor(now time.Time) time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.state != PeerDead {
+		return 0
+	}
+
+	return now.Sub(p.diedAt)
+}
+
+// assess updates the state of a peer from its phi. Suspected peers are probed
+// through other peers, a peer is only reported dead once no probe is pending.
+func (n *Node) assess(ctx context.Context, id string, peer *Peer) {
+	n.lock.Lock()
+	expected := n.expectedInterval(id)
+	n.lock.Unlock()
+
+	now := time.Now()
+
+	peer.lock.Lock()
+	phi := peer.detector.phi(now, expected, n.config.PhiMinStdDeviation, n.config.PhiAcceptablePause)
+	silence := now.Sub(peer.lastHeartBeat)
+	previous := peer.state
+	peer.phi = phi
+
+	// a peer is suspected (and probed) before it is declared dead, unless it was
+	// silent for death_threshold on top of the time between our heartbeats to it
+	switch {
+		case previous == PeerDead:
+		case silence > n.config.DeathThreshold + expected - n.config.HeartBeatInterval,
+			previous == PeerSuspect && phi >= n.config.PhiDeathThreshold && !peer.probing.Load():
+			peer.state = PeerDead
+			peer.diedAt = now
+		case phi >= n.config.PhiSuspectThreshold:
+			peer.state = PeerSuspect
+		default:
+			peer.state = PeerAlive
+	}
+	state := peer.state
+	peer.lock.Unlock()
+
+	if state == previous {
+		return
+	}
+
+	// let the cluster know, the peer refutes it with a new incarnation if it is still around
+	if state != PeerAlive {
+		n.gossip.push(peer.update(id))
+	}
+
+	switch state {
+		case PeerSuspect:
+			fmt.Printf("Suspecting %s, phi %.1f after %s of silence\n", id, phi, silence.Round(time.Millisecond))
+			if peer.probing.CompareAndSwap(false, true) {
+				n.spawn("indirect probe", func() { n.probeIndirectly(ctx, id, peer) })
+			}
+		case PeerDead:
+			fmt.Printf("Peer %s is dead, phi %.1f after %s of silence\n", id, phi, silence.Round(time.Millisecond))
+			n.reportDeath(id)
+	}
+}
+
+// probeIndirectly asks up to indirect_probes alive peers to reach a suspected peer,
+// a network problem between two nodes alone doesn't kill anyone
+func (n *Node) probeIndirectly(ctx context.Context, id string, peer *Peer) {
+	defer peer.probing.Store(false)
+
+	n.lock.Lock()
+	var helpers []string
+	for helperId, helper := range n.peerTable {
+		if helperId != id && helper.alive() {
+			helpers = append(helpers, helper.address)
+		}
+	}
+	n.lock.Unlock()
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	helpers = helpers[:min(len(helpers), n.config.IndirectProbes)]
+
+	if len(helpers) == 0 {
+		return
+	}
+
+	// the helper's own probe is bounded by its call timeout
+	ctx, cancel := context.WithTimeout(ctx, 2 * n.config.CallTimeout)
+	defer cancel()
+
+	reached := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		n.spawn("indirect probe", func() {
+			args := ProbeArgs{
+				RequesterID: n.id,
+				Target: id,
+				Address: peer.address,
+			}
+			var reply ProbeReply
+
+			err := call(ctx, helper, "Node.Probe", &args, &reply)
+			reached <- err == nil && reply.Reached
+		})
+	}
+
+	for range helpers {
+		if <-reached {
+			fmt.Printf("Peer %s was reached indirectly\n", id)
+			peer.reached(time.Now())
+			return
+		}
+	}
+}
+
+// Probe pings a peer on behalf of a node that suspects it
+func (n *Node) Probe(args *ProbeArgs, reply *ProbeReply) error {
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.CallTimeout)
+	defer cancel()
+
+	var pong PingReply
+	if err := call(ctx, args.Address, "Node.Ping", &PingArgs{Sender: n.id}, &pong); err != nil {
+		return nil
+	}
+
+	reply.Reached = pong.Receiver == args.Target
+
+	return nil
+}
+
+// Ping only proves this node is up, it doesn't touch the peer table
+func (n *Node) Ping(args *PingArgs, reply *PingReply) error {
+	reply.Receiver = n.id
+	return nil
+}
+
+// Peers exposes the peer table with the failure detector's view of every peer
+func (n *Node) Peers(args *PeersArgs, reply *PeersReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for id, peer := range n.peerTable {
+		peer.lock.Lock()
+		reply.Peers = append(reply.Peers, PeerStatus{
+			ID: id,
+			Address: peer.address,
+			IsPrimary: peer.isPrimary,
+			MaritalStatus: peer.maritalStatus,
+			State: peer.state,
+			Phi: peer.phi,
+			LastHeartBeat: peer.lastHeartBeat,
+			Zone: peer.zone,
+			FreeBudget: peer.freeBudget,
+			Load: peer.load,
+			Latency: peer.latency,
+		})
+		peer.lock.Unlock()
+	}
+
+	sort.Slice(reply.Peers, func(i, j int) bool {
+		return reply.Peers[i].ID < reply.Peers[j].ID
+	})
+
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+const EventSteppedDown = "stepped_down"
+
+// Every data set has a lineage, the id of the primary it was first committed
+// to, and a term that grows whenever a replica of the lineage is promoted.
+// Two primaries of one lineage mean a primary came back after its replica
+// took over, the one with the older term is stale. Co-replicas of one dead
+// primary promote into the same term, there the lower node id wins.
+
+// supersedes reports whether the primary a in term aTerm replaced the primary b in term bTerm
+func supersedes(a string, aTerm uint64, b string, bTerm uint64) bool {
+	return aTerm > bTerm || aTerm == bTerm && a < b
+}
+
+// fence compares what a heartbeat tells about a peer with our own marriage
+func (n *Node) fence(peerId string, isPrimary bool, lineage string, term uint64) {
+	n.lock.Lock()
+	stale := n.isPrimary && isPrimary && lineage == n.lineage && supersedes(peerId, term, n.id, n.term)
+	// our primary stepped down, the primary that fenced it owns the data now.
+	// A heartbeat older than our term predates its promotion instead.
+	abandoned := !n.isPrimary && n.maritalStatus && n.marriedTo == peerId && !isPrimary && term >= n.term
+	n.lock.Unlock()
+
+	if stale {
+		n.spawn("step down", func() { n.stepDown(peerId, term) })
+		return
+	}
+
+	if abandoned {
+		n.divorce(peerId)
+	}
+}
+
+// stepDown turns a stale primary into a replica of the primary that replaced
+// it. The newer primary replicates to it and pulls back, through anti entropy,
+// whatever it committed while it was partitioned.
+func (n *Node) stepDown(newPrimary string, term uint64) {
+	n.marriageLock.Lock()
+	defer n.marriageLock.Unlock()
+
+	n.lock.Lock()
+	if !n.isPrimary || !supersedes(newPrimary, term, n.id, n.term) {
+		n.lock.Unlock()
+		return
+	}
+
+	peer, ok := n.peerTable[newPrimary]
+	if !ok {
+		n.lock.Unlock()
+		return
+	}
+
+	fmt.Printf("%s -> Primary %s took over in term %d, stepping down from term %d\n", n.id, newPrimary, term, n.term)
+
+	// married before asking, the new primary may sync with us right away
+	replicas := n.replicas
+	n.isPrimary = false
+	n.replicas = make(map[string]*replicaState)
+	// proposals still out are rolled back on confirmation
+	n.proposals = make(map[string]string)
+	n.marriedTo = newPrimary
+	n.maritalStatus = true
+	// married through Rejoin, not a proposal
+	n.proposalID = ""
+
+	// everything committed here belongs to the new primary now
+	for hash, status := range n.fileStatusTable {
+		if status != 0 {
+			n.fileOwners[hash] = newPrimary
+		}
+	}
+
+	args := RejoinArgs{
+		RequesterID: n.id,
+		Lineage: n.lineage,
+		Term: n.term,
+	}
+	n.lock.Unlock()
+	var reply RejoinReply
+
+	// outlives the heartbeat that noticed the new primary, so it is bounded on its own
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.CallTimeout)
+	defer cancel()
+
+	if err := call(ctx, peer.address, "Node.Rejoin", &args, &reply); err != nil || !reply.Granted {
+		fmt.Printf("Could not rejoin %s, staying primary until the next heartbeat\n", newPrimary)
+		n.lock.Lock()
+		n.isPrimary = true
+		n.replicas = replicas
+		n.marriedTo = ""
+		n.maritalStatus = len(replicas) > 0
+		n.lock.Unlock()
+		return
+	}
+
+	n.lock.Lock()
+	n.term = reply.Term
+	n.lock.Unlock()
+
+	n.emit(EventSteppedDown, fmt.Sprintf("primary %s took over in term %d, rejoined it as replica", newPrimary, reply.Term))
+	n.saveState()
+}
+
+// divorce leaves a primary that stepped down. The copies stay, the primary hands them to its successor.
+func (n *Node) divorce(primary string) {
+	n.marriageLock.Lock()
+	defer n.marriageLock.Unlock()
+
+	n.lock.Lock()
+	if n.isPrimary || n.marriedTo != primary {
+		n.lock.Unlock()
+		return
+	}
+
+	n.marriedTo = ""
+	n.maritalStatus = false
+	n.proposalID = ""
+	n.lineage = n.id
+	n.term = 0
+	n.lock.Unlock()
+
+	fmt.Printf("%s -> Primary %s stepped down, divorcing\n", n.id, primary)
+	n.emit(EventPartnerDied, fmt.Sprintf("primary %s stepped down", primary))
+
+	n.saveState()
+}
+
+// Rejoin marries a stale primary of our lineage as a replica
+func (n *Node) Rejoin(args *RejoinArgs, reply *RejoinReply) error {
+	n.marriageLock.Lock()
+	defer n.marriageLock.Unlock()
+
+	n.lock.Lock()
+	if !n.isPrimary || args.Lineage != n.lineage {
+		n.lock.Unlock()
+		return errors.New("Not the primary of this lineage")
+	}
+
+	if !supersedes(n.id, n.term, args.RequesterID, args.Term) {
+		n.lock.Unlock()
+		return errors.New("Requester is not stale")
+	}
+
+	if _, ok := n.peerTable[args.RequesterID]; !ok {
+		n.lock.Unlock()
+		return errors.New("Unknown requester")
+	}
+
+	// the stale primary may hold commits we lack, so it may exceed the replication factor
+	if _, ok := n.replicas[args.RequesterID]; !ok {
+		n.addReplica(args.RequesterID)
+	}
+
+	reply.Granted = true
+	reply.Term = n.term
+	n.lock.Unlock()
+
+	n.emit(EventMarried, fmt.Sprintf("stale primary %s rejoined as replica", args.RequesterID))
+	n.saveState()
+
+	// pull what it committed while partitioned once it answers as our replica
+	n.spawn("rejoin anti entropy", func() {
+		if err := n.reconcile(context.Background(), args.RequesterID); err != nil {
+			fmt.Printf("Anti entropy with %s failed: %s\n", args.RequesterID, err)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoReplicasPromotingTogetherEndWithOnePrimary(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	threeCopies := func(c *Config) {
+		quickDeath(c)
+		c.ReplicationFactor = 3
+	}
+	primary, listener := startListeningNode(t, true, threeCopies)
+	a := startNode(t, false, threeCopies)
+	b := startNode(t, false, threeCopies)
+	introduce(t, ctx, primary, a, b)
+
+	var rounds sync.WaitGroup
+	defer rounds.Wait()
+	defer cancel()
+	tick(ctx, &rounds, a, b)
+
+	primaryCtx, stopPrimary := context.WithCancel(ctx)
+	var primaryRounds sync.WaitGroup
+	tick(primaryCtx, &primaryRounds, primary)
+
+	eventually(t, 5 * time.Second, "both replicas to marry the primary", func() bool {
+		primary.lock.Lock()
+		defer primary.lock.Unlock()
+		return len(primary.replicas) == 2
+	})
+
+	stopPrimary()
+	primaryRounds.Wait()
+	listener.Close()
+
+	// both notice the death at once and promote into the same term
+	var promotions sync.WaitGroup
+	for _, replica := range []*Node{a, b} {
+		promotions.Add(1)
+		go func() {
+			defer promotions.Done()
+			replica.promote(primary.id)
+		}()
+	}
+	promotions.Wait()
+
+	winner, loser := a, b
+	if b.id < a.id {
+		winner, loser = b, a
+	}
+
+	eventually(t, 5 * time.Second, "the higher id to rejoin the lower as replica", func() bool {
+		winner.lock.Lock()
+		_, rejoined := winner.replicas[loser.id]
+		winner.lock.Unlock()
+
+		loser.lock.Lock()
+		defer loser.lock.Unlock()
+		return rejoined && !loser.isPrimary && loser.marriedTo == winner.id
+	})
+
+	winner.lock.Lock()
+	defer winner.lock.Unlock()
+	if !winner.isPrimary || winner.lineage != primary.id || winner.term != 1 {
+		t.Fatalf("winner is primary %t of lineage %s in term %d", winner.isPrimary, winner.lineage, winner.term)
+	}
+}
@@ -2,12 +2,25 @@ module node
 
 go 1.22.1
 
-require github.com/schollz/peerdiscovery v1.7.2
+require (
+	github.com/klauspost/compress v1.17.6
+	github.com/klauspost/reedsolomon v1.12.1
+	github.com/minio/minio-go/v7 v7.0.70
+	github.com/schollz/peerdiscovery v1.7.2
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
-	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/goccy/go-json v0.10.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.2.6 // indirect
+	github.com/minio/md5-simd v1.1.2 // indirect
+	github.com/rs/xid v1.5.0 // indirect
 	github.com/stretchr/testify v1.7.0 // indirect
-	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/crypto v0.21.0 // indirect
+	golang.org/x/net v0.23.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/text v0.14.0 // indirect
+	gopkg.in/ini.v1 v1.67.0 // indirect
 )
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// updates piggybacked on a single heartbeat
+const maxPiggyback = 16
+
+// MemberUpdate is a membership delta spread by gossip. A higher incarnation,
+// which only the member itself can raise, wins over anything said about it
+// before, at equal incarnations dead beats suspect beats alive.
+type MemberUpdate struct {
+	ID string
+	Address string
+	IsPrimary bool
+	MaritalStatus bool
+	// PeerAlive, PeerSuspect or PeerDead
+	State string
+	Incarnation uint64
+}
+
+var stateRank = map[string]int{
+	PeerAlive: 0,
+	PeerSuspect: 1,
+	PeerDead: 2,
+}
+
+// departure remembers a forgotten peer, so stale gossip doesn't bring it back
+type departure struct {
+	incarnation uint64
+	at time.Time
+}
+
+type queuedUpdate struct {
+	update MemberUpdate
+	sent int
+}
+
+// gossipQueue holds the updates still to be spread, one per member
+type gossipQueue struct {
+	lock sync.Mutex
+	pending map[string]*queuedUpdate
+}
+
+func (q *gossipQueue) push(u MemberUpdate) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.pending == nil {
+		q.pending = make(map[string]*queuedUpdate)
+	}
+
+	// newer news about a member replaces the older ones
+	q.pending[u.ID] = &queuedUpdate{update: u}
+}
+
+// take returns up to limit of the least spread updates, an update is
+// dropped once it has been sent maxSends times
+func (q *gossipQueue) take(limit int, maxSends int) []MemberUpdate {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	queued := make([]*queuedUpdate, 0, len(q.pending))
+	for _, qu := range q.pending {
+		queued = append(queued, qu)
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		return queued[i].sent < queued[j].sent
+	})
+
+	var updates []MemberUpdate
+	for _, qu := range queued[:min(limit, len(queued))] {
+		updates = append(updates, qu.update)
+
+		qu.sent++
+		if qu.sent >= maxSends {
+			delete(q.pending, qu.update.ID)
+		}
+	}
+
+	return updates
+}
+
+// the Node methods below are called with n.lock held
+
+func (n *Node) selfUpdate() MemberUpdate {
+	return MemberUpdate{
+		ID: n.id,
+		Address: n.address,
+		IsPrimary: n.isPrimary,
+		MaritalStatus: n.maritalStatus,
+		State: PeerAlive,
+		Incarnation: n.incarnation,
+	}
+}
+
+func (p *Peer) update(id string) MemberUpdate {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return MemberUpdate{
+		ID: id,
+		Address: p.address,
+		IsPrimary: p.isPrimary,
+		MaritalStatus: p.maritalStatus,
+		State: p.state,
+		Incarnation: p.incarnation,
+	}
+}
+
+// announce gossips a new incarnation of this node whenever its role or marriage changed
+func (n *Node) announce() {
+	u := n.selfUpdate()
+	u.Incarnation = n.announced.Incarnation
+	if u == n.announced {
+		return
+	}
+
+	n.incarnation++
+	n.announced = n.selfUpdate()
+	n.gossip.push(n.announced)
+}
+
+// piggyback picks the updates sent along with the next heartbeat or reply
+func (n *Node) piggyback() []MemberUpdate {
+	// every update reaches the whole cluster with high probability within O(log n) rounds
+	maxSends := 3 * int(math.Ceil(math.Log2(float64(len(n.peerTable) + 2))))
+
+	return n.gossip.take(maxPiggyback, maxSends)
+}
+
+// join records a peer that contacted us or answered our first heartbeat and spreads the news
+func (n *Node) join(id string, peer *Peer) {
+	delete(n.departed, id)
+	n.peerTable[id] = peer
+	n.discoveredAddresses[peer.address] = time.Now()
+	n.gossip.push(peer.update(id))
+}
+
+// applyUpdates merges membership deltas received from a peer, callers hold n.lock
+func (n *Node) applyUpdates(updates []MemberUpdate) {
+	for _, u := range updates {
+		n.applyUpdate(u)
+	}
+}
+
+func (n *Node) applyUpdate(u MemberUpdate) {
+	if u.ID == n.id {
+		// refute rumours of our own death with a new incarnation
+		if u.State != PeerAlive && u.Incarnation >= n.incarnation {
+			n.incarnation = u.Incarnation + 1
+			n.announced = n.selfUpdate()
+			n.gossip.push(n.announced)
+		}
+		return
+	}
+
+	peer, ok := n.peerTable[u.ID]
+	if !ok {
+		if u.State == PeerDead {
+			return
+		}
+
+		// only a new incarnation of a forgotten peer is news, hearing from it directly always is
+		if d, ok := n.departed[u.ID]; ok && u.Incarnation <= d.incarnation {
+			return
+		}
+
+		fmt.Printf("Learned about peer %s (%s) through gossip\n", u.ID, u.Address)
+		peer = newPeer(u.Address)
+		peer.learn(u.IsPrimary, u.MaritalStatus, nil, u.Incarnation)
+		n.join(u.ID, peer)
+		return
+	}
+
+	// only our own detector may end a marriage, gossip merely clears or raises suspicion
+	if n.isPartner(u.ID) && u.State == PeerDead {
+		u.State = PeerSuspect
+	}
+
+	if peer.merge(u) {
+		n.gossip.push(u)
+	}
+}
+
+// merge applies an update that is news to the peer, false if it is old news
+func (p *Peer) merge(u MemberUpdate) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if u.Incarnation < p.incarnation {
+		return false
+	}
+
+	newer := u.Incarnation > p.incarnation
+	if !newer && stateRank[u.State] <= stateRank[p.state] {
+		return false
+	}
+
+	if newer {
+		p.incarnation = u.Incarnation
+		p.isPrimary = u.IsPrimary
+		p.maritalStatus = u.MaritalStatus
+	}
+
+	// a new incarnation means someone heard from the peer itself
+	if u.State == PeerAlive {
+		p.lastHeartBeat = time.Now()
+		p.detector.last = p.lastHeartBeat
+	}
+	if u.State == PeerDead && p.state != PeerDead {
+		p.diedAt = time.Now()
+	}
+	p.state = u.State
+
+	return true
+}
+
+// forgetDead drops peers dead for longer than dead_peer_retention from the
+// peer table, their death was gossiped when they died. Partners are left to
+// the marriage, which ends on their death. Departures are kept as long again.
+func (n *Node) forgetDead(now time.Time) {
+	if n.config.DeadPeerRetention <= 0 {
+		return
+	}
+
+	for id, peer := range n.peerTable {
+		if n.isPartner(id) || peer.deadFor(now) <= n.config.DeadPeerRetention {
+			continue
+		}
+
+		fmt.Printf("Forgetting %s, dead for over %s\n", id, n.config.DeadPeerRetention)
+		n.departed[id] = departure{incarnation: peer.update(id).Incarnation, at: now}
+		delete(n.peerTable, id)
+	}
+
+	for id, d := range n.departed {
+		if now.Sub(d.at) > n.config.DeadPeerRetention {
+			delete(n.departed, id)
+		}
+	}
+}
+
+// gossipTargets picks the peers heartbeated this round: every partner and the
+// next gossip_fanout peers of a shuffled round robin, so every peer is pinged
+// once per len(peers) / gossip_fanout rounds
+func (n *Node) gossipTargets() []string {
+	if n.config.GossipFanout < 1 {
+		ids := make([]string, 0, len(n.peerTable))
+		for id := range n.peerTable {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	chosen := make(map[string]struct{})
+	var targets []string
+	for _, id := range n.partners() {
+		if _, ok := n.peerTable[id]; ok {
+			chosen[id] = struct{}{}
+			targets = append(targets, id)
+		}
+	}
+
+	picked := 0
+	for i := 0; i < len(n.peerTable) && picked < n.config.GossipFanout; i++ {
+		if n.probeNext >= len(n.probeOrder) {
+			n.probeOrder = n.probeOrder[:0]
+			for id := range n.peerTable {
+				n.probeOrder = append(n.probeOrder, id)
+			}
+			rand.Shuffle(len(n.probeOrder), func(i, j int) {
+				n.probeOrder[i], n.probeOrder[j] = n.probeOrder[j], n.probeOrder[i]
+			})
+			n.probeNext = 0
+		}
+
+		id := n.probeOrder[n.probeNext]
+		n.probeNext++
+
+		if _, ok := n.peerTable[id]; !ok {
+			continue
+		}
+		if _, ok := chosen[id]; ok {
+			continue
+		}
+
+		chosen[id] = struct{}{}
+		targets = append(targets, id)
+		picked++
+	}
+
+	return targets
+}
+
+// expectedInterval is how often we expect to hear from a peer: partners every
+// heartbeat, anyone else once per round robin pass
+func (n *Node) expectedInterval(id string) time.Duration {
+	if n.config.GossipFanout < 1 || n.isPartner(id) {
+		return n.config.HeartBeatInterval
+	}
+
+	rounds := math.Ceil(float64(len(n.peerTable)) / float64(n.config.GossipFanout))
+
+	return time.Duration(math.Max(rounds, 1)) * n.config.HeartBeatInterval
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func quickDeath(c *Config) {
+	c.GossipFanout = 1
+	c.DeathThreshold = 300 * time.Millisecond
+	c.DeadPeerRetention = 500 * time.Millisecond
+}
+
+// knows reports whether the peer table of n holds exactly ids, all alive
+func knows(n *Node, ids ...string) bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	var known []string
+	for id, peer := range n.peerTable {
+		if !peer.alive() {
+			return false
+		}
+		known = append(known, id)
+	}
+	sort.Strings(known)
+
+	var want []string
+	for _, id := range ids {
+		if id != n.id {
+			want = append(want, id)
+		}
+	}
+	sort.Strings(want)
+
+	if len(known) != len(want) {
+		return false
+	}
+	for i := range known {
+		if known[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMembershipConverges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var nodes []*Node
+	var ids []string
+	for i := 0; i < 4; i++ {
+		n := startNode(t, false, quickDeath)
+		nodes = append(nodes, n)
+		ids = append(ids, n.id)
+	}
+	victim, listener := startListeningNode(t, false, quickDeath)
+
+	// everyone only knows the seed, the rest is up to gossip
+	seed := nodes[0]
+	for _, n := range append(nodes[1:], victim) {
+		if err := n.sendFirstHeartBeat(ctx, seed.address); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rounds sync.WaitGroup
+	defer rounds.Wait()
+	defer cancel()
+	tick(ctx, &rounds, nodes...)
+
+	victimCtx, stopVictim := context.WithCancel(ctx)
+	var victimRounds sync.WaitGroup
+	tick(victimCtx, &victimRounds, victim)
+
+	everyone := append(ids, victim.id)
+	eventually(t, 10 * time.Second, "every node to know every other", func() bool {
+		for _, n := range append(nodes, victim) {
+			if !knows(n, everyone...) {
+				return false
+			}
+		}
+		return true
+	})
+
+	stopVictim()
+	victimRounds.Wait()
+	listener.Close()
+
+	// the death is noticed, gossiped and finally forgotten everywhere
+	eventually(t, 10 * time.Second, "the dead node to be forgotten", func() bool {
+		for _, n := range nodes {
+			if !knows(n, ids...) {
+				return false
+			}
+		}
+		return true
+	})
+
+	// rumours still going round must not bring it back
+	time.Sleep(300 * time.Millisecond)
+	for _, n := range nodes {
+		if !knows(n, ids...) {
+			t.Fatalf("%s brought the dead node back", n.id)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const EventProposalRolledBack = "proposal_rolled_back"
+
+// A marriage takes two phases. The primary proposes and the replica accepts,
+// which only engages it: it turns down every other proposal until the primary
+// confirms, cancels or proposal_timeout passes. Only a confirmed proposal
+// marries both, anything else is rolled back, so concurrent proposers can't
+// leave a replica married to more than one primary or a primary with more
+// replicas than it asked for.
+
+// engagement is a proposal this replica accepted and waits to see confirmed
+type engagement struct {
+	id string
+	proposer string
+	lineage string
+	term uint64
+	expires time.Time
+}
+
+func newProposalID() string {
+	id_bytes := make([]byte, 16)
+	rand.Read(id_bytes)
+
+	return fmt.Sprintf("%x", id_bytes)
+}
+
+// recruit proposes to as many unmarried peers as replica slots are open, picked
+// by the partner_selection strategy. Every outgoing proposal holds its slot until
+// it is confirmed or rolled back.
+func (n *Node) recruit(ctx context.Context, peers map[string]*Peer) {
+	n.lock.Lock()
+	if !n.wantsReplicas() {
+		n.lock.Unlock()
+		return
+	}
+
+	proposals := make(map[string]string)
+	for _, c := range n.selectPartners(peers) {
+		fmt.Printf("Proposing to %s (zone %q, %d free, load %d, latency %s)\n", c.ID, c.Zone, c.FreeBudget, c.Load, c.Latency.Round(time.Millisecond))
+		proposals[c.ID] = newProposalID()
+		n.proposals[c.ID] = proposals[c.ID]
+	}
+	n.lock.Unlock()
+
+	for id, proposalID := range proposals {
+		n.spawn("proposal", func() { n.sendProposal(ctx, id, proposalID) })
+	}
+}
+
+// sendProposal runs both phases of a proposal to peerId and rolls it back on the replica
+// should the confirmation fail or the proposal have been withdrawn in the meantime
+func (n *Node) sendProposal(ctx context.Context, peerId string, proposalID string) error {
+	// the slot is free again however the proposal ends
+	defer func() {
+		n.lock.Lock()
+		if n.proposals[peerId] == proposalID {
+			delete(n.proposals, peerId)
+		}
+		n.lock.Unlock()
+	}()
+
+	fmt.Printf("Sending proposal %s to %s\n", proposalID, peerId)
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.ProposalTimeout)
+	defer cancel()
+
+	n.lock.Lock()
+	peer, ok := n.peerTable[peerId]
+	args := ProposeArgs{
+		ProposalID: proposalID,
+		Proposer: n.id,
+		Lineage: n.lineage,
+		Term: n.term,
+	}
+	n.lock.Unlock()
+
+	if !ok {
+		return errors.New("Peer is not in the peer table")
+	}
+
+	var reply ProposeReply
+	callCtx, callCancel := context.WithTimeout(ctx, n.config.CallTimeout)
+	err := call(callCtx, peer.address, "Node.Propose", &args, &reply)
+	callCancel()
+	if err != nil {
+		// the replica may have accepted before the answer got lost
+		n.cancelProposal(peer.address, peerId, proposalID)
+		return err
+	}
+
+	if !reply.Granted {
+		fmt.Printf("Peer %s rejected proposal\n", peerId)
+		return nil
+	}
+
+	n.marriageLock.Lock()
+	defer n.marriageLock.Unlock()
+
+	// a step down withdraws every proposal, a Rejoin may have married the peer already
+	n.lock.Lock()
+	_, married := n.replicas[peerId]
+	current := n.isPrimary && n.proposals[peerId] == proposalID && !married
+	n.lock.Unlock()
+
+	if !current {
+		fmt.Printf("Proposal to %s was withdrawn\n", peerId)
+		n.cancelProposal(peer.address, peerId, proposalID)
+		return errors.New("Proposal withdrawn")
+	}
+
+	confirmArgs := ConfirmProposalArgs{
+		ProposalID: proposalID,
+		Proposer: n.id,
+	}
+	var confirmReply ConfirmProposalReply
+	callCtx, callCancel = context.WithTimeout(ctx, n.config.CallTimeout)
+	err = call(callCtx, peer.address, "Node.ConfirmProposal", &confirmArgs, &confirmReply)
+	callCancel()
+	if err == nil && !confirmReply.Confirmed {
+		err = errors.New("Proposal was not confirmed")
+	}
+	if err != nil {
+		fmt.Printf("Could not confirm proposal to %s: %s\n", peerId, err)
+		n.cancelProposal(peer.address, peerId, proposalID)
+		return err
+	}
+
+	fmt.Printf("Peer %s accepted proposal\n", peerId)
+	n.lock.Lock()
+	delete(n.proposals, peerId)
+	n.addReplica(peerId)
+	n.lock.Unlock()
+	n.emit(EventMarried, fmt.Sprintf("married replica %s", peerId))
+	n.saveState()
+
+	return nil
+}
+
+// isOrphan tells whether the sender of a heartbeat believes it married us through
+// a proposal we never saw confirmed. Called with n.lock held.
+func (n *Node) isOrphan(args *HeartBeatArgs) bool {
+	if !n.isPrimary || args.IsPrimary || args.MarriedTo != n.id || args.ProposalID == "" {
+		return false
+	}
+
+	// a proposal still being confirmed adds the replica once the confirmation is back
+	_, married := n.replicas[args.Sender]
+	_, proposing := n.proposals[args.Sender]
+
+	return !married && !proposing
+}
+
+// cancelProposal rolls a proposal back on the replica. It gets a deadline of
+// its own as the proposal's may be over, if it is lost an unconfirmed
+// engagement still expires after proposal_timeout.
+func (n *Node) cancelProposal(address string, peerId string, proposalID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), n.config.CallTimeout)
+	defer cancel()
+
+	args := CancelProposalArgs{
+		ProposalID: proposalID,
+		Proposer: n.id,
+	}
+	var reply CancelProposalReply
+
+	if err := call(ctx, address, "Node.CancelProposal", &args, &reply); err != nil {
+		fmt.Printf("Could not roll back proposal to %s: %s\n", peerId, err)
+	}
+}
+
+// Propose engages an unmarried replica to the proposer until the proposal is
+// confirmed, cancelled or expires, other proposals are turned down meanwhile
+func (n *Node) Propose(args *ProposeArgs, reply *ProposeReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.isPrimary {
+		return errors.New("Only secondaries can get proposals")
+	}
+
+	if n.maritalStatus {
+		return errors.New("Already married!")
+	}
+
+	if args.ProposalID == "" {
+		return errors.New("Proposal without id")
+	}
+
+	if e := n.engagement; e != nil && e.id != args.ProposalID && time.Now().Before(e.expires) {
+		return errors.New(fmt.Sprintf("Already engaged to %s", e.proposer))
+	}
+
+	n.engagement = &engagement{
+		id: args.ProposalID,
+		proposer: args.Proposer,
+		lineage: args.Lineage,
+		term: args.Term,
+		expires: time.Now().Add(n.config.ProposalTimeout),
+	}
+	reply.Granted = true
+
+	return nil
+}
+
+// ConfirmProposal marries the replica to the primary it is engaged to
+func (n *Node) ConfirmProposal(args *ConfirmProposalArgs, reply *ConfirmProposalReply) error {
+	n.lock.Lock()
+	// a retried confirmation
+	if !n.isPrimary && n.maritalStatus && n.marriedTo == args.Proposer && n.proposalID == args.ProposalID {
+		n.lock.Unlock()
+		reply.Confirmed = true
+		return nil
+	}
+
+	e := n.engagement
+	if n.isPrimary || n.maritalStatus || e == nil || e.id != args.ProposalID || e.proposer != args.Proposer {
+		n.lock.Unlock()
+		return errors.New("Unknown proposal")
+	}
+
+	n.engagement = nil
+	if time.Now().After(e.expires) {
+		n.lock.Unlock()
+		return errors.New("Proposal expired")
+	}
+
+	n.marriedTo = e.proposer
+	n.maritalStatus = true
+	n.lineage = e.lineage
+	n.term = e.term
+	n.proposalID = e.id
+	n.lock.Unlock()
+	reply.Confirmed = true
+
+	n.emit(EventMarried, fmt.Sprintf("married primary %s", args.Proposer))
+
+	n.saveState()
+
+	return nil
+}
+
+// CancelProposal drops an engagement, or undoes the marriage of a proposal
+// whose confirmation the primary never saw succeed
+func (n *Node) CancelProposal(args *CancelProposalArgs, reply *CancelProposalReply) error {
+	n.lock.Lock()
+	if e := n.engagement; e != nil && e.id == args.ProposalID && e.proposer == args.Proposer {
+		n.engagement = nil
+		n.lock.Unlock()
+		return nil
+	}
+
+	married := !n.isPrimary && n.maritalStatus && n.marriedTo == args.Proposer && n.proposalID == args.ProposalID
+	if married {
+		n.marriedTo = ""
+		n.maritalStatus = false
+		n.lineage = n.id
+		n.term = 0
+		n.proposalID = ""
+	}
+	n.lock.Unlock()
+
+	if married {
+		n.emit(EventProposalRolledBack, fmt.Sprintf("primary %s rolled back its proposal", args.Proposer))
+		n.saveState()
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRacingProposersMarryOnce(t *testing.T) {
+	ctx := context.Background()
+
+	replica := startNode(t, false, nil)
+	primaries := []*Node{startNode(t, true, nil), startNode(t, true, nil), startNode(t, true, nil)}
+	for _, primary := range primaries {
+		introduce(t, ctx, primary, replica)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(primaries))
+	for i, primary := range primaries {
+		proposalID := newProposalID()
+		primary.lock.Lock()
+		primary.proposals[replica.id] = proposalID
+		primary.lock.Unlock()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = primary.sendProposal(ctx, replica.id, proposalID)
+		}()
+	}
+	wg.Wait()
+
+	var husbands []string
+	for i, primary := range primaries {
+		primary.lock.Lock()
+		_, married := primary.replicas[replica.id]
+		proposals := len(primary.proposals)
+		primary.lock.Unlock()
+
+		if proposals != 0 {
+			t.Errorf("%s still holds %d proposals", primary.id, proposals)
+		}
+		if married {
+			husbands = append(husbands, primary.id)
+			continue
+		}
+		if errs[i] == nil || !strings.Contains(errs[i].Error(), "Already engaged") {
+			t.Errorf("losing proposal of %s ended with %v, want Already engaged", primary.id, errs[i])
+		}
+	}
+
+	replica.lock.Lock()
+	defer replica.lock.Unlock()
+	if len(husbands) != 1 || !replica.maritalStatus || replica.marriedTo != husbands[0] {
+		t.Fatalf("replica married to %q, primaries married to it: %v", replica.marriedTo, husbands)
+	}
+	if replica.engagement != nil {
+		t.Fatalf("replica is still engaged to %s", replica.engagement.proposer)
+	}
+}
+
+func TestExpiredEngagementIsNotConfirmed(t *testing.T) {
+	replica := startNode(t, false, func(c *Config) { c.ProposalTimeout = 50 * time.Millisecond })
+
+	var reply ProposeReply
+	if err := replica.Propose(&ProposeArgs{ProposalID: "first", Proposer: "a"}, &reply); err != nil || !reply.Granted {
+		t.Fatalf("first proposal failed: %v", err)
+	}
+	if err := replica.Propose(&ProposeArgs{ProposalID: "second", Proposer: "b"}, &reply); err == nil {
+		t.Fatal("engaged replica accepted a second proposal")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	var confirmed ConfirmProposalReply
+	if err := replica.ConfirmProposal(&ConfirmProposalArgs{ProposalID: "first", Proposer: "a"}, &confirmed); err == nil {
+		t.Fatal("expired proposal was confirmed")
+	}
+
+	// the expired engagement no longer blocks anyone
+	reply = ProposeReply{}
+	if err := replica.Propose(&ProposeArgs{ProposalID: "third", Proposer: "c"}, &reply); err != nil || !reply.Granted {
+		t.Fatalf("proposal after expiry failed: %v", err)
+	}
+
+	replica.lock.Lock()
+	defer replica.lock.Unlock()
+	if replica.maritalStatus {
+		t.Fatalf("replica married %s", replica.marriedTo)
+	}
+}
+
+func TestLostConfirmationIsRolledBack(t *testing.T) {
+	ctx := context.Background()
+
+	primary := startNode(t, true, nil)
+	replica := startNode(t, false, nil)
+	introduce(t, ctx, primary, replica)
+
+	// the replica confirmed, but neither the confirmation nor the rollback reached the primary
+	var proposed ProposeReply
+	if err := replica.Propose(&ProposeArgs{ProposalID: "lost", Proposer: primary.id, Lineage: primary.id}, &proposed); err != nil {
+		t.Fatal(err)
+	}
+	var confirmed ConfirmProposalReply
+	if err := replica.ConfirmProposal(&ConfirmProposalArgs{ProposalID: "lost", Proposer: primary.id}, &confirmed); err != nil {
+		t.Fatal(err)
+	}
+
+	replica.lock.Lock()
+	peer := replica.peerTable[primary.id]
+	replica.lock.Unlock()
+
+	// the next heartbeat tells the primary, which rolls the marriage back
+	if err := replica.sendHeartBeat(ctx, primary.id, peer); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, 5 * time.Second, "the orphaned marriage to be rolled back", func() bool {
+		replica.lock.Lock()
+		defer replica.lock.Unlock()
+		return !replica.maritalStatus && replica.proposalID == ""
+	})
+
+	primary.lock.Lock()
+	defer primary.lock.Unlock()
+	if _, ok := primary.replicas[replica.id]; ok {
+		t.Fatal("primary married the replica")
+	}
+}
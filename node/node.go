@@ -1,72 +1,206 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"flag"
 	"net"
 	"net/rpc"
 	"net/http"
 	"math/rand"
-	"github.com/schollz/peerdiscovery"
 	"time"
 	"os"
     "os/signal"
     "syscall"
 	"errors"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type Peer struct {
 	address string
+
+	// guards everything below but the atomics
+	lock sync.Mutex
 	isPrimary bool
 	maritalStatus bool
+	// codecs the peer accepts on the wire
+	compressions []string
+	// highest incarnation heard of, see MemberUpdate
+	incarnation uint64
+
 	lastHeartBeat time.Time
+	detector phiDetector
+	// PeerAlive, PeerSuspect or PeerDead
+	state string
+	phi float64
+	// when the peer was last reported dead
+	diedAt time.Time
+
+	// failure domain, free budget and load the peer advertises, heartbeat round trip, see PartnerSelector
+	zone string
+	freeBudget int
+	load int
+	latency time.Duration
+	// set once a heartbeat with the peer told the above, gossip alone doesn't
+	described bool
+
+	// set while a heartbeat to this peer is outstanding so slow peers don't pile up goroutines
+	inFlight atomic.Bool
+	// set while other peers try to reach this suspected peer
+	probing atomic.Bool
 }
 
+// Node state is guarded by lock, which is never held across an RPC or blob I/O.
+// Marriage changes spanning an RPC hold marriageLock first. Peers, queues and
+// status trackers have locks of their own that are always taken last.
 type Node struct {
 	id string
 	address string
+	config *Config
+	store BlobStore
+
+	lock sync.Mutex
 
 	isPrimary bool
 	maritalStatus bool
+	// the primary of a replica, primaries keep their replicas in replicas
 	marriedTo string
-
-	discoveredAddresses map[string]struct{}
+	// who first committed the data this node holds and the marriage term, see fence
+	lineage string
+	term uint64
+	replicas map[string]*replicaState
+	// orders the peers proposed to, see selection.go
+	selector PartnerSelector
+	// outgoing proposals of a primary by peer, each holds a replica slot, see marriage.go
+	proposals map[string]string
+	// proposal a replica accepted and waits to see confirmed, and the one its marriage was confirmed by
+	engagement *engagement
+	proposalID string
+
+	discoverers []Discoverer
+	// when a peer last answered on every discovered address
+	discoveredAddresses map[string]time.Time
 	peerTable map[string]*Peer
+	// peers forgotten after their death, see forgetDead
+	departed map[string]departure
+
+	// raised to refute suspicion or announce a new role, see gossip.go
+	incarnation uint64
+	announced MemberUpdate
+	gossip gossipQueue
+	// shuffled round robin of the peers to heartbeat
+	probeOrder []string
+	probeNext int
 
 	fileBudget int
 
 	fileBookings map[string]int
+	// at rest codec of every booking
+	bookingCompression map[string]string
+	// 0 uploaded, 1 committed, 2 held by every replica
 	fileStatusTable map[string]int
+	// at rest codec of every stored blob, replicas store their copy the same way
+	fileCodecs map[string]string
+	// primary every replicated file was committed by
+	fileOwners map[string]string
 
 	trees map[string]*MerkleTree
 	treesStatus map[string]int
+	// where the shards of every erasure coded file live
+	shardPlacements map[string]*ShardPlacement
 
 	marriageLock sync.Mutex
+
+	// requests being served, advertised as load
+	load atomic.Int64
+
+	// every goroutine started through spawn, waited for on shutdown
+	goroutines sync.WaitGroup
+
+	scrubState scrubState
+	replicationState replicationState
+	eventLog eventLog
+
+	// where the node state survives restarts, "" keeps it in memory only
+	statePath string
+	stateLock sync.Mutex
+	// saves asked for and saves on disk, see saveState
+	stateWanted atomic.Uint64
+	stateWritten atomic.Uint64
 }
 
-func (n *Node) init(address string, isPrimary bool, fileBudget int) {
+func (n *Node) init(address string, config *Config) error {
 	// Intitialize all maps
 	n.fileBookings = make(map[string]int)
+	n.bookingCompression = make(map[string]string)
 	n.fileStatusTable = make(map[string]int)
+	n.fileCodecs = make(map[string]string)
+	n.fileOwners = make(map[string]string)
 	n.peerTable = make(map[string]*Peer)
-	n.discoveredAddresses = make(map[string]struct{})
+	n.discoveredAddresses = make(map[string]time.Time)
+	n.departed = make(map[string]departure)
 	n.trees = make(map[string]*MerkleTree)
 	n.treesStatus = make(map[string]int)
+	n.shardPlacements = make(map[string]*ShardPlacement)
+	n.replicas = make(map[string]*replicaState)
+	n.proposals = make(map[string]string)
 
 	// set passed arguments
 	n.address = address
-	n.isPrimary = isPrimary
-	n.fileBudget = fileBudget
+	n.config = config
+	n.isPrimary = config.Primary
+	n.fileBudget = config.Budget
+	n.discoverers = newDiscoverers(config, address, n.discoveryPayload)
+	n.selector = newPartnerSelector(config.PartnerSelection)
 
 	// set id
 	id_bytes := make([]byte, 32)
     rand.Read(id_bytes)
 	n.id = fmt.Sprintf("%x", id_bytes)
+	n.lineage = n.id
 
 	// set everything else to default
 	n.maritalStatus = false
 	n.marriedTo = ""
+
+	// a previous run's state brings back its id and with it the blobs of the store
+	n.statePath = config.StateFile
+	if err := n.loadState(); err != nil {
+		return err
+	}
+
+	err, store := newBlobStore(config, n.id)
+	if err != nil {
+		return err
+	}
+	n.store = store
+
+	return nil
+}
+
+// spawn runs a short lived task in its own goroutine. A panic is logged instead
+// of taking the node down and shutdown waits for the task through n.goroutines.
+func (n *Node) spawn(name string, fn func()) {
+	n.goroutines.Add(1)
+	go func() {
+		defer n.goroutines.Done()
+		defer func() {
+			if r := recover(); r != nil {
+				fmt.Printf("%s crashed: %v\n", name, r)
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// supervise keeps a long running loop alive until ctx is cancelled, see supervise in util.go
+func (n *Node) supervise(ctx context.Context, name string, fn func(ctx context.Context)) {
+	n.spawn(name, func() { supervise(ctx, name, fn) })
 }
 
 func (n *Node) HeartBeat(args *HeartBeatArgs, reply *HeartBeatReply) error {
@@ -77,79 +211,187 @@ func (n *Node) HeartBeat(args *HeartBeatArgs, reply *HeartBeatReply) error {
 		args.MaritalStatus,
 	)
 
-	if _, ok := n.peerTable[args.Sender]; !ok {
-		n.peerTable[args.Sender] = &Peer{
-			address: args.Address,
-			isPrimary: args.IsPrimary,
-			maritalStatus: args.MaritalStatus,
-			lastHeartBeat: time.Now(),
-		}
+	n.lock.Lock()
+	peer, ok := n.peerTable[args.Sender]
+	if !ok {
+		peer = newPeer(args.Address)
 	} else {
-		n.peerTable[args.Sender].lastHeartBeat = time.Now()
-		n.peerTable[args.Sender].maritalStatus = args.MaritalStatus
-		n.peerTable[args.Sender].isPrimary = args.IsPrimary
+		peer.heard(time.Now())
+	}
+	peer.learn(args.IsPrimary, args.MaritalStatus, args.Compressions, args.Incarnation)
+	peer.describe(args.Zone, args.FreeBudget, args.Load)
+	if !ok {
+		n.join(args.Sender, peer)
 	}
 
-	// // break double marriage if you are a replica 
-	// if n.marriedTo == args.Sender && args.MarriedTo != n.id && args.MaritalStatus {
-	// 	// as good as dead
-	// 	n.reportDeath(n.marriedTo)
-	// }
+	n.applyUpdates(args.Updates)
 
 	reply.Receiver = n.id
 	reply.IsPrimary = n.isPrimary
 	reply.MaritalStatus = n.maritalStatus
 	reply.MarriedTo = n.marriedTo
+	reply.Compressions = n.wireCompressions()
+	reply.Lineage = n.lineage
+	reply.Term = n.term
+	reply.Incarnation = n.incarnation
+	reply.Updates = n.piggyback()
+	reply.Zone = n.config.Zone
+	reply.FreeBudget = n.fileBudget
+	// not counting this heartbeat
+	reply.Load = max(int(n.load.Load()) - 1, 0)
+	orphaned := n.isOrphan(args)
+	n.lock.Unlock()
+
+	// the replica missed both the confirmation and its rollback, roll back again
+	if orphaned {
+		fmt.Printf("%s believes it is married to us, rolling back proposal %s\n", args.Sender, args.ProposalID)
+		n.spawn("orphan rollback", func() { n.cancelProposal(args.Address, args.Sender, args.ProposalID) })
+	}
+
+	n.fence(args.Sender, args.IsPrimary, args.Lineage, args.Term)
 
 	return nil
 }
 
+// heartBeatArgs tells a peer who we are, along with the gossip for it
+func (n *Node) heartBeatArgs() HeartBeatArgs {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	return HeartBeatArgs{
+		Sender: n.id,
+		Address: n.address,
+		IsPrimary: n.isPrimary,
+		MaritalStatus: n.maritalStatus,
+		MarriedTo: n.marriedTo,
+		ProposalID: n.proposalID,
+		Compressions: n.wireCompressions(),
+		Lineage: n.lineage,
+		Term: n.term,
+		Incarnation: n.incarnation,
+		Updates: n.piggyback(),
+		Zone: n.config.Zone,
+		FreeBudget: n.fileBudget,
+		Load: int(n.load.Load()),
+	}
+}
+
+// wireCompressions lists the codecs this node accepts on the wire
+func (n *Node) wireCompressions() []string {
+	if !n.config.WireCompression {
+		return []string{CompressionNone}
+	}
+
+	return supportedCompressions
+}
+
 func (n *Node) UploadRequest(args *UploadRequestArgs, reply *UploadRequestReply) error {
+	if !isSupportedCompression(args.Compression) {
+		return errors.New("Unsupported compression " + args.Compression)
+	}
+
+	n.lock.Lock()
+	// a new booking replaces the unused rest of an earlier one, which goes back to the budget
+	left := max(n.fileBookings[args.RequesterID], 0)
+	available := n.fileBudget + left
+
 	// check if storage is available
-	if n.fileBudget < args.RequiredBudget{
+	if available < args.RequiredBudget{
 		reply.Granted = false
-		reply.Available = n.fileBudget
+		reply.Available = available
+		n.lock.Unlock()
 
 		return nil
 	}
 
-	n.fileBudget -= args.RequiredBudget
+	if left > 0 {
+		fmt.Printf("%s booked again, releasing %d unused files of its earlier booking\n", args.RequesterID, left)
+	}
+
+	n.fileBudget = available - args.RequiredBudget
 	n.fileBookings[args.RequesterID] = args.RequiredBudget
+	n.bookingCompression[args.RequesterID] = args.Compression
 
 	reply.Granted = true
 	reply.Available = n.fileBudget
+	n.lock.Unlock()
+
+	n.saveState()
 
 	return nil
 }
 
 func (n *Node) UploadFiles(args *UploadFilesArgs, reply *UploadFilesReply) error {
+	if !isSupportedCompression(args.Compression) {
+		return errors.New("Unsupported compression " + args.Compression)
+	}
+
+	n.lock.Lock()
 	if _, ok := n.fileBookings[args.RequesterID]; !ok {
+		n.lock.Unlock()
 		return errors.New("no bookings made!")
 	}
 
 	if n.fileBookings[args.RequesterID] < len(args.Files) {
+		n.lock.Unlock()
 		return errors.New("fileBudget crossed!")
 	}
 
+	// the whole batch is reserved while the blobs are written without the lock,
+	// what didn't make it goes back to the booking
+	n.fileBookings[args.RequesterID] -= len(args.Files)
+	codec := n.bookingCompression[args.RequesterID]
+	n.lock.Unlock()
+
+	defer func() {
+		n.lock.Lock()
+		defer n.lock.Unlock()
+
+		for _, hash := range reply.Uploaded {
+			// add to temp table
+			n.fileStatusTable[hash] = 0
+		}
+		if _, ok := n.fileBookings[args.RequesterID]; ok {
+			n.fileBookings[args.RequesterID] += len(args.Files) - reply.NumUploads
+		}
+	}()
+
 	reply.NumUploads = 0
-	for hash, content := range args.Files {
-		if hash != ComputeHash(content) {
-			return errors.New("computed hash does not match with provided hash!")
+	for hash, compressed := range args.Files {
+		err, content := decompress(args.Compression, []byte(compressed))
+		if err != nil {
+			return errors.New("Error decompressing file " + hash)
 		}
-		storeFile(n.id, hash, content)
 
-		// add to temp table
-		n.fileStatusTable[hash] = 0
+		if hash != ComputeHash(string(content)) {
+			return errors.New("computed hash does not match with provided hash!")
+		}
+		if err := n.writeBlob(hash, content, codec); err != nil {
+			fmt.Printf("Error storing %s: %s\n", hash, err)
+			return errors.New("Error storing file " + hash)
+		}
 
 		reply.Uploaded = append(reply.Uploaded, hash)
 		reply.NumUploads++
-		n.fileBookings[args.RequesterID]--
 	}
 
 	return nil
 }
 
 func (n *Node) CommitFiles(args *CommitFilesArgs, reply *CommitFilesReply) error {
+	if err := n.commitFiles(args, reply); err != nil {
+		return err
+	}
+
+	n.saveState()
+
+	return nil
+}
+
+func (n *Node) commitFiles(args *CommitFilesArgs, reply *CommitFilesReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
 	if _, ok := n.fileBookings[args.RequesterID]; !ok {
 		return errors.New("Bookings not made!")
 	}
@@ -182,6 +424,11 @@ func (n *Node) CommitFiles(args *CommitFilesArgs, reply *CommitFilesReply) error
 			}
 			
 			n.fileStatusTable[hash] = 1
+
+			// replicated files belong to the primary that sent them
+			if n.isPartner(args.RequesterID) {
+				n.fileOwners[hash] = args.RequesterID
+			}
 		}
 	}
 
@@ -192,100 +439,144 @@ func (n *Node) CommitFiles(args *CommitFilesArgs, reply *CommitFilesReply) error
 
 	// remove the booking entry made
 	delete(n.fileBookings, args.RequesterID)
+	delete(n.bookingCompression, args.RequesterID)
 
 	return nil
 }
 
 func (n *Node) DownloadFile(args *DownloadFileArgs, reply *DownloadFileReply) error {
-	if _, ok := n.trees[args.Merkle]; !ok {
+	// trees are never changed once stored, only replaced
+	n.lock.Lock()
+	t, ok := n.trees[args.Merkle]
+	n.lock.Unlock()
+	if !ok {
 		return errors.New("Merkle hash provided doesn't exist on this node")
 	}
 
-	err, content := readFile(n.id, n.trees[args.Merkle].indexToHash[args.Index])
-	if err != nil {
-		return err
+	hash, ok := t.indexToHash[args.Index]
+	if !ok {
+		return errors.New("Index provided doesn't exist in the tree")
 	}
 
-	// FIXME: skipping below check to make the designed system more meaningful for demo
-	// ideally it is assumed that a corrupted file will also result in a corrupted merkle
-	// tree. ex. a databse hack
-	// if ComputeHash(content) != n.trees[args.Merkle].indexToHash[args.Index] {
-	// 	return errors.New("File corrupted on server!")
-	// }
+	err, content := n.readBlob(hash)
+	if err != nil && !errors.Is(err, ErrBlobNotFound) {
+		fmt.Printf("Error reading file: %s\n", err)
+		return errors.New("Error reading file")
+	}
 
-	reply.Proof = n.trees[args.Merkle].GetProofByIndex(args.Index)
-	reply.Content = content
+	// a missing or rotten local copy is recovered from the partner (or the shards) and repaired on the way
+	if err != nil || ComputeHash(string(content)) != hash {
+		// erasure coded files are rebuilt on every read instead of stored whole again
+		n.lock.Lock()
+		sharded := n.isSharded(hash)
+		codec := n.fileCodec(hash)
+		n.lock.Unlock()
+		if !sharded {
+			fmt.Printf("Local copy of %s is missing or corrupted, recovering it\n", hash)
+		}
 
-	return nil
-}
+		err, recovered := n.recoverBlob(context.Background(), hash)
+		if err != nil {
+			fmt.Printf("Could not recover %s: %s\n", hash, err)
+			return errors.New("File corrupted on server!")
+		}
 
-func (n *Node) ReplicateMerkle(args *ReplicateMerkleArgs, reply *ReplicateMerkleReply) error {
-	// TODO:  this check should technically go in on every method
-	// thereby selectively opening up RPC API based on roles
-	if args.RequesterID != n.marriedTo {
-		return errors.New("Not my partner!")
+		if !sharded {
+			if err := n.writeBlob(hash, recovered, codec); err != nil {
+				fmt.Printf("Could not repair %s: %s\n", hash, err)
+			}
+		}
+
+		content = recovered
 	}
 
-	orderedHashes := make([]string, len(args.IndexMap))
-	for hash, index := range args.IndexMap {
-		orderedHashes[index] = hash 
+	reply.Compression = CompressionNone
+	if n.config.WireCompression {
+		reply.Compression = negotiateCompression(args.AcceptCompression)
 	}
 
-	t := MerkleTree{}
-	for i, mh := range orderedHashes {
-		if i == 0 {
-			t.Init(mh)
-		} else {
-			t.AddLeaf(mh)
-		}
+	err, compressed := compress(reply.Compression, content)
+	if err != nil {
+		return errors.New("Error compressing file")
 	}
 
-	if t.root.hash != args.Merkle {
-		return errors.New("The replication does not match the original!")
+	reply.Proof = t.GetProofByIndex(args.Index)
+	reply.Content = string(compressed)
+
+	return nil
+}
+
+// Info tells clients who this node is and where its partners can be reached
+func (n *Node) Info(args *NodeInfoArgs, reply *NodeInfoReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	reply.ID = n.id
+	reply.Address = n.address
+	reply.IsPrimary = n.isPrimary
+	reply.MaritalStatus = n.maritalStatus
+
+	for _, id := range n.partners() {
+		if peer, ok := n.peerTable[id]; ok {
+			reply.Partners = append(reply.Partners, id)
+			reply.PartnerAddresses = append(reply.PartnerAddresses, peer.address)
+		}
 	}
 
-	n.trees[t.root.hash] = &t
-	n.treesStatus[t.root.hash] = 0
-	reply.Success = true
+	// older clients only know a single partner
+	if len(reply.Partners) > 0 {
+		reply.MarriedTo = reply.Partners[0]
+		reply.PartnerAddress = reply.PartnerAddresses[0]
+	}
+	reply.Compressions = n.wireCompressions()
 
 	return nil
 }
 
-func (n *Node) Propose(args *ProposeArgs, reply *ProposeReply) error {
-	if n.maritalStatus {
-		return errors.New("Already married!")
+func (n *Node) ReplicateMerkle(args *ReplicateMerkleArgs, reply *ReplicateMerkleReply) error {
+	err, t := treeFromIndexMap(args.IndexMap)
+	if err != nil {
+		return err
 	}
 
-	if n.isPrimary {
-		return errors.New("Only secondaries can get proposals")
+	if t.root.hash != args.Merkle {
+		return errors.New("The replication does not match the original!")
+	}
+
+	n.lock.Lock()
+	// TODO:  this check should technically go in on every method
+	// thereby selectively opening up RPC API based on roles
+	if !n.isPartner(args.RequesterID) {
+		n.lock.Unlock()
+		return errors.New("Not my partner!")
 	}
 
-	n.marriageLock.Lock()
-	defer n.marriageLock.Unlock()
+	n.trees[t.root.hash] = t
+	n.treesStatus[t.root.hash] = 0
+	n.lock.Unlock()
+	reply.Success = true
 
-	n.marriedTo = args.Proposer
-	n.maritalStatus = true
-	reply.Granted = true
+	n.saveState()
 
 	return nil
 }
 
-func (n *Node) sendFirstHeartBeat(address string) error {
-	args := HeartBeatArgs{
-		Sender: n.id,
-		Address: n.address,
-		IsPrimary: n.isPrimary,
-		MaritalStatus: n.maritalStatus,
-	}
+func (n *Node) sendFirstHeartBeat(ctx context.Context, address string) error {
+	args := n.heartBeatArgs()
 	
 	var reply HeartBeatReply
 
 	fmt.Printf("Sending first heart beat to: %s\n", address)
-	
-	if err := call(address, "Node.HeartBeat", &args, &reply); err != nil {
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.CallTimeout)
+	defer cancel()
+
+	sent := time.Now()
+	if err := call(ctx, address, "Node.HeartBeat", &args, &reply); err != nil {
 		fmt.Printf("Missed first heartbeat to %s\n", address)
 		return err
 	}
+	rtt := time.Since(sent)
 
 	fmt.Printf("%s-> id: %s, isPrimary: %t, maritalStatus: %t\n", 
 		address, 
@@ -294,76 +585,42 @@ func (n *Node) sendFirstHeartBeat(address string) error {
 		reply.MaritalStatus,
 	)
 
-	n.peerTable[reply.Receiver] = &Peer{
-		address: address,
-		isPrimary: reply.IsPrimary,
-		maritalStatus: reply.MaritalStatus,
-		lastHeartBeat: time.Now(),
-	}
-
-	return nil
-}
-
-func (n *Node) sendProposal(peerId string) error {
-	fmt.Printf("Sending Proposal to %s\n", peerId)
-
-	if !n.isPrimary {
-		return errors.New("Only primary can send proposals")
-	}
-
-	if n.maritalStatus && n.marriedTo != "" {
-		return errors.New(fmt.Sprintf("Already married to %s", n.marriedTo))
-	}
-
-	n.marriageLock.Lock()
-	defer n.marriageLock.Unlock()
-
-	args := ProposeArgs{
-		Proposer: n.id,
-	}
-
-	var reply ProposeReply
-	err := call (n.peerTable[peerId].address, "Node.Propose", &args, &reply)
-	if err != nil {
-		return err
-	}
+	peer := newPeer(address)
+	peer.learn(reply.IsPrimary, reply.MaritalStatus, reply.Compressions, reply.Incarnation)
+	peer.describe(reply.Zone, reply.FreeBudget, reply.Load)
+	peer.measured(rtt)
 
-	if !reply.Granted {
-		fmt.Printf("Peer %s rejected proposal\n", peerId)
-		return nil
-	}
+	n.lock.Lock()
+	n.join(reply.Receiver, peer)
+	n.applyUpdates(reply.Updates)
+	n.lock.Unlock()
 
-	fmt.Printf("Peer %s accepted proposal\n", peerId)
-	n.marriedTo = peerId
-	n.maritalStatus = true
+	n.fence(reply.Receiver, reply.IsPrimary, reply.Lineage, reply.Term)
 
 	return nil
 }
 
 func (n *Node) reportDeath(peerId string) error {
+	n.lock.Lock()
+	partner, isPrimary := n.isPartner(peerId), n.isPrimary
+	n.lock.Unlock()
 
-	if n.marriedTo == peerId {
-		if n.isPrimary {
+	if partner {
+		if isPrimary {
 			fmt.Printf("%s -> Reporting death of my beloved replica %s\n", n.id, peerId)
 
-			n.maritalStatus = false
-			n.marriedTo = ""
-
-			for hash, _ := range n.fileStatusTable {
-				n.fileStatusTable[hash] = 1
-			}
-
-			for hash, _ := range n.treesStatus {
-				n.treesStatus[hash] = 0
-			}
+			// checkHeartBeats recruits a replacement, which then receives everything
+			n.lock.Lock()
+			n.removeReplica(peerId)
+			n.lock.Unlock()
+			n.emit(EventPartnerDied, fmt.Sprintf("replica %s died", peerId))
+			n.saveState()
 
 			return nil
 		} else {
 			fmt.Printf("%s -> Reporting death of my beloved primary %s\n", n.id, peerId)
 
-			n.isPrimary = true
-			n.maritalStatus = false
-			n.marriedTo = ""
+			n.promote(peerId)
 
 			return nil
 		}
@@ -373,220 +630,626 @@ func (n *Node) reportDeath(peerId string) error {
 	return nil
 }
 
-func (n *Node) replicateTrees() error {
+func (n *Node) replicateTrees(ctx context.Context) error {
+	n.lock.Lock()
 	var pendingTrees []string
 	for hash, status := range n.treesStatus {
 		if status == 0 {
 			pendingTrees = append(pendingTrees, hash)
 		}
 	}
+	partners := n.partners()
+	n.lock.Unlock()
 
 	if len(pendingTrees) == 0 {
 		fmt.Println("Nothing to replicate!")
 		return nil
 	}
 
+	for _, replica := range partners {
+		if err := n.replicateTreesTo(ctx, replica, pendingTrees); err != nil {
+			fmt.Printf("Failure replicating trees to %s\n", replica)
+			n.replicationState.fail(err)
+		}
+	}
+
+	return nil
+}
+
+func (n *Node) replicateTreesTo(ctx context.Context, replica string, pendingTrees []string) error {
+	err, address := n.peerAddress(replica)
+	if err != nil {
+		return err
+	}
+
 	for _, tHash := range pendingTrees {
+		n.lock.Lock()
+		r, married := n.replicas[replica]
+		if !married {
+			n.lock.Unlock()
+			return errors.New("No longer married to " + replica)
+		}
+		_, done := r.trees[tHash]
+		t, ok := n.trees[tHash]
+		n.lock.Unlock()
+
+		if done || !ok {
+			continue
+		}
+
 		replicateTreesArgs := ReplicateMerkleArgs{
 			RequesterID: n.id,
-			IndexMap: n.trees[tHash].hashToIndex,
+			IndexMap: t.hashToIndex,
 			Merkle: tHash,
 		}
 		var replicateTreesReply ReplicateMerkleReply
 
-		err := call(n.peerTable[n.marriedTo].address, "Node.ReplicateMerkle", &replicateTreesArgs, &replicateTreesReply)
-		if err != nil || !replicateTreesReply.Success {
-			fmt.Printf("Failure replicating trees\n")
+		callCtx, cancel := context.WithTimeout(ctx, n.config.TransferTimeout)
+		err := call(callCtx, address, "Node.ReplicateMerkle", &replicateTreesArgs, &replicateTreesReply)
+		cancel()
+		if err != nil {
 			return err
 		}
+		if !replicateTreesReply.Success {
+			return errors.New("Replica rejected tree " + tHash)
+		}
+
+		n.lock.Lock()
+		n.markTreeReplicated(replica, tHash)
+		n.lock.Unlock()
 	}
 
 	return nil
 }
 
-func (n *Node) replicateFiles() error {
-	var pendingFiles []string
+// peerAddress looks up where a peer listens
+func (n *Node) peerAddress(id string) (err error, address string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	peer, ok := n.peerTable[id]
+	if !ok {
+		return errors.New("Peer " + id + " is not in the peer table"), ""
+	}
+
+	return nil, peer.address
+}
+
+// replicate runs one replication round, a round still in progress makes it a no-op
+func (n *Node) replicate(ctx context.Context) {
+	if !n.replicationState.start() {
+		return
+	}
+
+	defer n.replicationState.finish()
+
+	n.replicateFiles(ctx)
+	n.replicateTrees(ctx)
+
+	// what the replicas acknowledged is saved once per round, a restart
+	// before that only sends it again
+	n.saveState()
+}
+
+// replicateFiles sends every committed file to replicas until it has
+// replication_factor - 1 copies. Replicas short on budget take what fits.
+func (n *Node) replicateFiles(ctx context.Context) error {
+	n.lock.Lock()
+	var committedFiles []string
 	for hash, status := range n.fileStatusTable {
 		if status == 1 {
+			committedFiles = append(committedFiles, hash)
+		}
+	}
+	partners := n.partners()
+	n.lock.Unlock()
+
+	if len(committedFiles) == 0 {
+		fmt.Println("Nothing to replicate!")
+		return nil
+	}
+
+	// a full replica always holds the same prefix, overflow replicas the rest
+	sort.Strings(committedFiles)
+
+	// one slow or full replica must not hold back the others
+	for _, replica := range partners {
+		if err := n.replicateFilesTo(ctx, replica, committedFiles); err != nil {
+			fmt.Printf("Replication to %s failed: %s\n", replica, err)
+			n.replicationState.fail(err)
+		}
+	}
+
+	n.lock.Lock()
+	committed, replicated, ratio := n.redundancyRatio()
+	n.lock.Unlock()
+	if replicated < committed {
+		fmt.Printf("%d of %d committed files are not fully replicated, redundancy ratio %.2f\n", committed - replicated, committed, ratio)
+	}
+
+	return nil
+}
+
+func (n *Node) replicateFilesTo(ctx context.Context, replica string, committedFiles []string) error {
+	err, address := n.peerAddress(replica)
+	if err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	r, ok := n.replicas[replica]
+	if !ok {
+		n.lock.Unlock()
+		return errors.New("No longer married to " + replica)
+	}
+
+	var pendingFiles []string
+	codecs := make(map[string]string)
+	for _, hash := range committedFiles {
+		// an earlier replica of this round may have completed it
+		if n.fileStatusTable[hash] != 1 {
+			continue
+		}
+
+		if _, ok := r.files[hash]; !ok {
 			pendingFiles = append(pendingFiles, hash)
+			codecs[hash] = n.fileCodec(hash)
 		}
 	}
+	n.lock.Unlock()
 
 	if len(pendingFiles) == 0 {
-		fmt.Println("Nothing to replicate!")
 		return nil
 	}
 
+	n.replicationState.queue(len(pendingFiles))
+
+	cohortSize := n.config.ReplicationCohortSize
+	if cohortSize < 1 {
+		cohortSize = len(pendingFiles)
+	}
+
+	// every cohort is booked, sent and recorded on its own, so a failed round
+	// resumes with the files the replica doesn't hold yet
+	for start := 0; start < len(pendingFiles); {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		// a booking has a single at rest codec, a cohort ends where the codec changes
+		codec := codecs[pendingFiles[start]]
+		end := start + 1
+		for end < min(start + cohortSize, len(pendingFiles)) && codecs[pendingFiles[end]] == codec {
+			end++
+		}
+		cohort := pendingFiles[start:end]
+		start = end
+
+		err, granted := n.bookReplica(ctx, address, len(cohort), codec)
+		if err != nil {
+			return err
+		}
+
+		full := granted < len(cohort)
+		n.lock.Lock()
+		r.full = full
+		n.lock.Unlock()
+		if granted == 0 {
+			fmt.Printf("Replica %s budget is exhausted! Cannot ensure redundancy\n", replica)
+			return nil
+		}
+
+		if granted < len(cohort) {
+			fmt.Printf("Replica %s only has room for %d more files\n", replica, granted)
+			cohort = cohort[:granted]
+		}
+
+		if err := n.replicateCohort(ctx, replica, address, cohort); err != nil {
+			return err
+		}
+
+		if full {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// bookReplica books budget for up to count files stored with codec on the
+// replica at address, settling for whatever the replica has left when that is less
+func (n *Node) bookReplica(ctx context.Context, address string, count int, codec string) (err error, granted int) {
 	// TODO: the replica must authenticate the primary ideally
 	// TODO: atleast for now a 'if' check would do
 	uploadReqArgs := UploadRequestArgs{
-		RequiredBudget: len(pendingFiles),
+		RequiredBudget: count,
 		RequesterID: n.id,
+		Compression: codec,
 	}
 	var uploadReqReply UploadRequestReply
 
-	err := call(n.peerTable[n.marriedTo].address, "Node.UploadRequest", &uploadReqArgs, &uploadReqReply)
+	bookCtx, cancel := context.WithTimeout(ctx, n.config.CallTimeout)
+	defer cancel()
 
-	if err != nil {
-		return err
+	if err := call(bookCtx, address, "Node.UploadRequest", &uploadReqArgs, &uploadReqReply); err != nil {
+		return err, 0
+	}
+
+	if uploadReqReply.Granted {
+		return nil, count
+	}
+
+	if uploadReqReply.Available < 1 {
+		return nil, 0
+	}
+
+	uploadReqArgs.RequiredBudget = uploadReqReply.Available
+	uploadReqReply = UploadRequestReply{}
+	if err := call(bookCtx, address, "Node.UploadRequest", &uploadReqArgs, &uploadReqReply); err != nil {
+		return err, 0
 	}
 
 	if !uploadReqReply.Granted {
-		// INFO: technically we should be able to support replica that have lesser storage capacity
-		// but the entire point of the protocol is 2 Gether Until Death
-		fmt.Printf("Replica budget is exhausted! Cannot ensure redundancy")
-		return nil
+		return nil, 0
+	}
+
+	return nil, uploadReqArgs.RequiredBudget
+}
+
+func (n *Node) replicateCohort(ctx context.Context, replica string, address string, cohort []string) error {
+	codec := CompressionNone
+	if n.config.WireCompression {
+		n.lock.Lock()
+		if peer, ok := n.peerTable[replica]; ok {
+			codec = negotiateCompression(peer.codecs())
+		}
+		n.lock.Unlock()
 	}
 
 	filesMap := make(map[string]string)
-	for _, fileHash := range pendingFiles {
-		err, content := readFile(n.id, fileHash)
+	size := 0
+	for _, fileHash := range cohort {
+		err, content := n.readBlob(fileHash)
 		if err != nil {
 			return err
 		}
 
-		filesMap[fileHash] = content
+		// leave bad copies to the scrubber instead of failing the whole cohort on the replica
+		if ComputeHash(string(content)) != fileHash {
+			fmt.Printf("Skipping corrupted file %s\n", fileHash)
+			continue
+		}
+
+		err, compressed := compress(codec, content)
+		if err != nil {
+			return err
+		}
+
+		filesMap[fileHash] = string(compressed)
+		size += len(compressed)
 	}
 
 	uploadArgs := UploadFilesArgs {
 		RequesterID: n.id,
 		Files: filesMap,
+		Compression: codec,
 	}
 	var uploadReply UploadFilesReply
 
-	err = call(n.peerTable[n.marriedTo].address, "Node.UploadFiles", &uploadArgs, &uploadReply)
+	started := time.Now()
+
+	uploadCtx, cancel := context.WithTimeout(ctx, n.config.TransferTimeout)
+	defer cancel()
+	err := call(uploadCtx, address, "Node.UploadFiles", &uploadArgs, &uploadReply)
 	if err != nil {
 		fmt.Printf("Replication failed\n")
 		return err
 	}
 
-	if uploadReply.NumUploads != len(pendingFiles) {
-		fmt.Printf("Some files were not replicated!")
+	if uploadReply.NumUploads != len(filesMap) {
+		fmt.Printf("Some files were not replicated!\n")
 	}
 
+	// committing releases the booking on the replica, a file only counts as
+	// replicated once the replica acknowledged the commit
+	commitArgs := CommitFilesArgs{
+		RequesterID: n.id,
+		Hashes: uploadReply.Uploaded,
+	}
+	var commitReply CommitFilesReply
+
+	commitCtx, commitCancel := context.WithTimeout(ctx, n.config.CallTimeout)
+	defer commitCancel()
+	if err := call(commitCtx, address, "Node.CommitFiles", &commitArgs, &commitReply); err != nil {
+		fmt.Printf("Replica %s did not commit the cohort\n", replica)
+		return err
+	}
+
+	n.lock.Lock()
 	for _, uh := range uploadReply.Uploaded {
-		n.fileStatusTable[uh] = 2
+		n.markFileReplicated(replica, uh)
 	}
+	n.lock.Unlock()
+	n.replicationState.sent(uploadReply.NumUploads, size)
 
-	return nil
+	return n.throttle(ctx, started, size)
 }
 
-func (n *Node) checkHeartBeats() error {
+// throttle waits until sending size bytes since started stays within replication_bandwidth
+func (n *Node) throttle(ctx context.Context, started time.Time, size int) error {
+	if n.config.ReplicationBandwidth <= 0 {
+		return nil
+	}
+
+	budget := time.Duration(float64(size) / float64(n.config.ReplicationBandwidth) * float64(time.Second))
+	wait := budget - time.Since(started)
+	if wait <= 0 {
+		return nil
+	}
 
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+	}
+}
+
+// checkHeartBeats never waits on a peer, every heartbeat runs in its own
+// goroutine bounded by the call timeout so a hung peer can't stall the ticker.
+// Every peer is assessed by the failure detector on its own each round, but
+// only the partners and gossip_fanout other peers are heartbeated, the rest
+// of the cluster hears about joins, deaths and roles through gossip.
+func (n *Node) checkHeartBeats(ctx context.Context) {
+	n.lock.Lock()
+	n.announce()
+	n.forgetDead(time.Now())
+	peers := make(map[string]*Peer, len(n.peerTable))
 	for id, peer := range n.peerTable {
-		if !peer.maritalStatus && n.isPrimary {
-			go n.sendProposal(id)
+		peers[id] = peer
+	}
+	targets := n.gossipTargets()
+	n.lock.Unlock()
+
+	for id, peer := range peers {
+		n.assess(ctx, id, peer)
+	}
+
+	// keeps recruiting until replication_factor - 1 replicas, also replacing dead ones
+	n.recruit(ctx, peers)
+
+	for _, id := range targets {
+		peer := peers[id]
+
+		// previous heartbeat is still waiting for an answer
+		if !peer.inFlight.CompareAndSwap(false, true) {
+			continue
 		}
 
-		if time.Now().Sub(peer.lastHeartBeat) > time.Second {
-			// send heartbeat
-			args := HeartBeatArgs{
-				Sender: n.id,
-				Address: n.address,
-				IsPrimary: n.isPrimary,
-				MaritalStatus: n.maritalStatus,
-			}
+		n.spawn("heartbeat", func() { n.sendHeartBeat(ctx, id, peer) })
+	}
+}
 
-			var reply HeartBeatReply
+func (n *Node) sendHeartBeat(ctx context.Context, id string, peer *Peer) error {
+	defer peer.inFlight.Store(false)
 
-			fmt.Printf("Sending heart beat to: %s\n", id)
-			
-			if err := call(peer.address, "Node.HeartBeat", &args, &reply); err != nil {
-				fmt.Printf("Missed heartbeat to %s\n", id)
+	args := n.heartBeatArgs()
 
-				if time.Now().Sub(peer.lastHeartBeat) > (60*time.Second) {
-					n.reportDeath(id)
-				}
+	var reply HeartBeatReply
 
-				return err
-			}
+	fmt.Printf("Sending heart beat to: %s\n", id)
 
-			// fmt.Printf("%s-> ip: %s, isPrimary: %t, maritalStatus: %t\n", 
-			// 	reply.Receiver, 
-			// 	peer.address, 
-			// 	reply.IsPrimary, 
-			// 	reply.MaritalStatus,
-			// )
+	ctx, cancel := context.WithTimeout(ctx, n.config.CallTimeout)
+	defer cancel()
 
-			// update peer information
-			peer.lastHeartBeat = time.Now()
-			peer.isPrimary = reply.IsPrimary
-			peer.maritalStatus = reply.MaritalStatus
+	sent := time.Now()
+	if err := call(ctx, peer.address, "Node.HeartBeat", &args, &reply); err != nil {
+		if errors.Is(err, ErrTimeout) {
+			fmt.Printf("Heartbeat to %s timed out\n", id)
+		} else {
+			fmt.Printf("Missed heartbeat to %s\n", id)
 		}
+
+		// the failure detector decides when silence means death
+		return err
 	}
 
+	// update peer information
+	peer.heard(time.Now())
+	peer.measured(time.Since(sent))
+	peer.learn(reply.IsPrimary, reply.MaritalStatus, reply.Compressions, reply.Incarnation)
+	peer.describe(reply.Zone, reply.FreeBudget, reply.Load)
+
+	n.lock.Lock()
+	n.applyUpdates(reply.Updates)
+	n.lock.Unlock()
+
+	n.fence(id, reply.IsPrimary, reply.Lineage, reply.Term)
+
 	return nil
 }
 
-func (n *Node) discoverNewPeers(limit int) {
-	//  TODO: Handle Error
-	discoveries, _ := peerdiscovery.Discover(peerdiscovery.Settings{Limit: limit})
-	for _, d := range discoveries {
-		if _, ok := n.discoveredAddresses[d.Address]; !ok {
-			fmt.Printf("Discovered new peer: %s\n", d.Address)
-			n.discoveredAddresses[d.Address] = struct{}{}
-			go n.sendFirstHeartBeat(d.Address)
+func main() {
+	configPath := flag.String("config", "", "YAML config file, TWOGUD_* environment variables override it")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration and exit")
+	flag.Bool("primary", false, "is this node a primary node")
+	flag.Int("budget", 1000, "how many 1MB files can this node manage")
+	flag.String("listen", "", "address the RPC listener binds to, empty binds all interfaces")
+	flag.String("port", defaultPort, "port the RPC listener binds to")
+	flag.String("advertise", "", "host[:port] announced to peers, defaults to the first non-loopback interface and --port")
+	flag.String("tls-cert", "", "PEM certificate of this node, enables TLS on the RPC listener")
+	flag.String("tls-key", "", "PEM private key of the node certificate")
+	flag.String("tls-ca", "", "PEM CA certificate that signs every node of the cluster")
+	flag.Bool("mtls", false, "require and verify certificates of everyone connecting to this node")
+	flag.String("zone", "", "failure domain (rack, zone) of this node, primaries avoid replicas in their own")
+	flag.String("peers", "", "comma separated host[:port] seed list, discovered next to multicast, DNS and file discovery")
+	flag.Parse()
+
+	err, config := loadConfig(*configPath)
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+
+	// only flags given on the command line override the file and environment
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+			case "primary":
+				config.Primary = f.Value.(flag.Getter).Get().(bool)
+			case "budget":
+				config.Budget = f.Value.(flag.Getter).Get().(int)
+			case "listen":
+				config.Listen = f.Value.String()
+			case "port":
+				config.Port = f.Value.String()
+			case "advertise":
+				config.Advertise = f.Value.String()
+			case "tls-cert":
+				config.TLS.Cert = f.Value.String()
+			case "tls-key":
+				config.TLS.Key = f.Value.String()
+			case "tls-ca":
+				config.TLS.CA = f.Value.String()
+			case "mtls":
+				config.TLS.Mutual = f.Value.(flag.Getter).Get().(bool)
+			case "peers":
+				config.Peers = splitList(f.Value.String())
+			case "zone":
+				config.Zone = f.Value.String()
 		}
+	})
+
+	if err := config.validate(); err != nil {
+		fmt.Printf("Invalid configuration:\n%s\n", err)
+		os.Exit(1)
 	}
-}
 
-func main() {
-	isPrimary := flag.Bool("primary", false, "is this node a primary node")
-	fileBudget := flag.Int("budget", 1000, "how many 1MB files can this node manage")
-	flag.Parse()
+	if *printConfig {
+		if err := config.print(); err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	var serverTLS *tls.Config
+	if config.TLS.Cert != "" {
+		err, serverTLS, tlsConfig = loadTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.CA, config.TLS.Mutual)
+		if err != nil {
+			fmt.Println("Error:", err)
+			os.Exit(1)
+		}
+	}
 
 	gracefulShutDown := make(chan os.Signal, 1)
 	signal.Notify(gracefulShutDown, syscall.SIGINT, syscall.SIGTERM)
 
+	// cancelled on shutdown, aborts every outstanding outbound call
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	// create a new instance
 	n := new(Node)
 	
+	// peers reach us on the advertised address, which may be a NAT or port mapping
+	advertised := config.Advertise
+	if advertised == "" {
+		advertised = GetLocalIP()
+	}
+	if _, _, err := net.SplitHostPort(advertised); err != nil {
+		advertised = net.JoinHostPort(strings.Trim(advertised, "[]"), config.Port)
+	}
+
 	// initialize
-	n.init(GetLocalIP(), *isPrimary, *fileBudget)
+	if err := n.init(advertised, config); err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
 	
 	rpc.Register(n)
 	rpc.HandleHTTP()
 
 	// Listen on a TCP address and port
-	listener, err := net.Listen("tcp", n.address + ":8080")
+	listener, err := net.Listen("tcp", net.JoinHostPort(config.Listen, config.Port))
 	if err != nil {
 		fmt.Println("Error:", err)
 		return
 	}
+	if serverTLS != nil {
+		listener = tls.NewListener(listener, serverTLS)
+	}
 	defer listener.Close()
-	go http.Serve(listener, nil)
+	n.supervise(ctx, "rpc server", func(ctx context.Context) {
+		if err := http.Serve(listener, n.countLoad(http.DefaultServeMux)); ctx.Err() == nil {
+			fmt.Println("RPC server stopped:", err)
+		}
+	})
 
-	fmt.Println("RPC server listening on", listener.Addr())
+	fmt.Println("RPC server listening on", listener.Addr(), "advertised as", n.address)
 
 	// we could use the same quit channel but seperate control is reserverd for future improvements
-	// discoveryTicker should technically tick at a much lower frequency.
-	discoveryTicker := time.NewTicker(1 * time.Second)
-	discoveryQuit := make(chan struct{})
-	heartBeatTicker := time.NewTicker(1 * time.Second)
+	replicationTicker := time.NewTicker(config.ReplicationInterval)
+	replicationQuit := make(chan struct{})
+	heartBeatTicker := time.NewTicker(config.HeartBeatInterval)
 	heartBeatQuit := make(chan struct{})
 
-	go func() {
+	// every long running loop is restarted should it crash
+	n.supervise(ctx, "discovery", n.runDiscovery)
+
+	if config.ScrubInterval > 0 {
+		n.supervise(ctx, "scrubber", n.runScrubber)
+	}
+
+	if config.AntiEntropyInterval > 0 {
+		n.supervise(ctx, "anti entropy", n.runAntiEntropy)
+	}
+
+	n.supervise(ctx, "ticker", func(ctx context.Context) {
 		for {
 			select {
-				case <-discoveryTicker.C:
-					n.discoverNewPeers(5)
-					if n.isPrimary && n.maritalStatus {
-						go n.replicateFiles()
-						go n.replicateTrees()
+				case <-replicationTicker.C:
+					n.lock.Lock()
+					isPrimary, married := n.isPrimary, n.maritalStatus
+					n.lock.Unlock()
+
+					if isPrimary && n.config.Redundancy == RedundancyErasure {
+						n.spawn("sharding", func() { n.shardFiles(ctx) })
+					} else if isPrimary && married {
+						n.spawn("replication", func() { n.replicate(ctx) })
 					}
-				case <-discoveryQuit:
-					discoveryTicker.Stop()
+				case <-replicationQuit:
+					replicationTicker.Stop()
 				case <-heartBeatTicker.C:
-					n.checkHeartBeats()
+					n.checkHeartBeats(ctx)
 				case <-heartBeatQuit:
 					heartBeatTicker.Stop()
 					return
+				case <-ctx.Done():
+					return
 			}
 		}
-	}()
-	// defer (discoveryQuit <- struct{}{})
+	})
+	// defer (replicationQuit <- struct{}{})
 	// defer (heartBeatQuit <- struct{}{})
 
 	<-gracefulShutDown
-	fmt.Printf("Gracefully shutting down!")
+	cancel()
+	listener.Close()
+	fmt.Printf("Gracefully shutting down!\n")
+
+	// outstanding calls were cancelled, give them a moment to unwind
+	done := make(chan struct{})
+	go func() {
+		n.goroutines.Wait()
+		close(done)
+	}()
+
+	select {
+		case <-done:
+		case <-time.After(n.config.CallTimeout):
+			fmt.Printf("Some goroutines did not stop in time\n")
+	}
 }
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startNode runs a node with an in-memory store on a loopback listener of its own
+func startNode(t *testing.T, primary bool, configure func(c *Config)) *Node {
+	t.Helper()
+
+	n, _ := startListeningNode(t, primary, configure)
+
+	return n
+}
+
+// startListeningNode is startNode handing out the listener, closing it takes the node off the network
+func startListeningNode(t *testing.T, primary bool, configure func(c *Config)) (*Node, net.Listener) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := defaultConfig()
+	config.Primary = primary
+	config.StorageBackend = "memory"
+	config.HeartBeatInterval = 20 * time.Millisecond
+	config.CallTimeout = time.Second
+	config.ProposalTimeout = 2 * time.Second
+	config.DiscoveryMulticast = false
+	if configure != nil {
+		configure(config)
+	}
+
+	n := new(Node)
+	if err := n.init(listener.Addr().String(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	// every node gets its own server, rpc.Register only takes one Node per process
+	server := rpc.NewServer()
+	if err := server.Register(n); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	go http.Serve(listener, mux)
+
+	t.Cleanup(func() {
+		listener.Close()
+		n.goroutines.Wait()
+	})
+
+	return n, listener
+}
+
+// introduce lets every node heartbeat every other node once
+func introduce(t *testing.T, ctx context.Context, nodes ...*Node) {
+	t.Helper()
+
+	for _, a := range nodes {
+		for _, b := range nodes {
+			if a == b {
+				continue
+			}
+			if err := a.sendFirstHeartBeat(ctx, b.address); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// tick runs the heartbeat and replication rounds of nodes until ctx is cancelled
+func tick(ctx context.Context, wg *sync.WaitGroup, nodes ...*Node) {
+	for _, n := range nodes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for ctx.Err() == nil {
+				n.checkHeartBeats(ctx)
+
+				n.lock.Lock()
+				isPrimary, married := n.isPrimary, n.maritalStatus
+				n.lock.Unlock()
+				if isPrimary && married {
+					n.replicate(ctx)
+				}
+
+				time.Sleep(5 * time.Millisecond)
+			}
+		}()
+	}
+}
+
+// upload books, uploads and commits files on n the way a client does,
+// asking for the files to be stored with codec
+func upload(n *Node, requester string, codec string, files map[string]string) error {
+	var booking UploadRequestReply
+	err := n.UploadRequest(&UploadRequestArgs{
+		RequesterID: requester,
+		RequiredBudget: len(files),
+		Compression: codec,
+	}, &booking)
+	if err != nil {
+		return err
+	}
+	if !booking.Granted {
+		return fmt.Errorf("booking of %d files refused, %d available", len(files), booking.Available)
+	}
+
+	var uploaded UploadFilesReply
+	err = n.UploadFiles(&UploadFilesArgs{
+		RequesterID: requester,
+		Files: files,
+		Compression: CompressionNone,
+	}, &uploaded)
+	if err != nil {
+		return err
+	}
+
+	var hashes []string
+	for hash := range files {
+		hashes = append(hashes, hash)
+	}
+
+	var committed CommitFilesReply
+	return n.CommitFiles(&CommitFilesArgs{RequesterID: requester, Hashes: hashes}, &committed)
+}
+
+// eventually polls cond until it holds or timeout passes
+func eventually(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadsDuringHeartBeatsAndReplication(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary := startNode(t, true, nil)
+	replica := startNode(t, false, nil)
+	other := startNode(t, false, nil)
+	introduce(t, ctx, primary, replica, other)
+
+	var rounds sync.WaitGroup
+	tick(ctx, &rounds, primary, replica, other)
+	defer rounds.Wait()
+	defer cancel()
+
+	const clients, batches = 4, 10
+	var uploads sync.WaitGroup
+	errs := make(chan error, clients * batches)
+	for c := 0; c < clients; c++ {
+		uploads.Add(1)
+		go func() {
+			defer uploads.Done()
+
+			for b := 0; b < batches; b++ {
+				files := make(map[string]string)
+				for f := 0; f < 3; f++ {
+					content := fmt.Sprintf("client %d batch %d file %d", c, b, f)
+					files[ComputeHash(content)] = content
+				}
+
+				if err := upload(primary, fmt.Sprintf("client-%d-%d", c, b), CompressionNone, files); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	uploads.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	eventually(t, 10 * time.Second, "every file to be replicated", func() bool {
+		return replicatedEverywhere(primary, clients * batches * 3)
+	})
+
+	primary.lock.Lock()
+	partners := primary.partners()
+	primary.lock.Unlock()
+	if len(partners) != 1 {
+		t.Fatalf("primary has %d replicas, want 1", len(partners))
+	}
+
+	holder := replica
+	if partners[0] == other.id {
+		holder = other
+	}
+
+	holder.lock.Lock()
+	defer holder.lock.Unlock()
+	for hash := range primary.fileStatusTable {
+		if holder.fileStatusTable[hash] != 1 {
+			t.Fatalf("replica did not commit %s", hash)
+		}
+	}
+}
+
+// replicatedEverywhere reports whether every file of primary reached every replica
+func replicatedEverywhere(primary *Node, files int) bool {
+	primary.lock.Lock()
+	defer primary.lock.Unlock()
+
+	if len(primary.fileStatusTable) != files {
+		return false
+	}
+	for _, status := range primary.fileStatusTable {
+		if status != 2 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReplicasKeepTheStoredCodec(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	primary := startNode(t, true, nil)
+	replica := startNode(t, false, nil)
+	introduce(t, ctx, primary, replica)
+
+	var rounds sync.WaitGroup
+	tick(ctx, &rounds, primary, replica)
+	defer rounds.Wait()
+	defer cancel()
+
+	// interleaved codecs, so cohorts have to be cut at every codec change
+	want := make(map[string]string)
+	for i, codec := range []string{CompressionZstd, CompressionNone, CompressionGzip, CompressionZstd} {
+		content := fmt.Sprintf("file %d stored with %s", i, codec)
+		hash := ComputeHash(content)
+		want[hash] = codec
+
+		if err := upload(primary, fmt.Sprintf("client-%d", i), codec, map[string]string{hash: content}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	eventually(t, 10 * time.Second, "every file to be replicated", func() bool {
+		return replicatedEverywhere(primary, len(want))
+	})
+
+	for hash, codec := range want {
+		err, blob := replica.store.Get(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blob[len(blobMagic)] != blobCodecIDs[codec] {
+			t.Errorf("replica stored %s with codec id %d, want %s", hash, blob[len(blobMagic)], codec)
+		}
+	}
+
+	// a lost copy is repaired from the replica with the codec it was stored with
+	for hash, codec := range want {
+		if err := primary.store.Delete(hash); err != nil {
+			t.Fatal(err)
+		}
+		if err := primary.repairBlob(ctx, hash); err != nil {
+			t.Fatal(err)
+		}
+
+		err, blob := primary.store.Get(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blob[len(blobMagic)] != blobCodecIDs[codec] {
+			t.Errorf("primary repaired %s with codec id %d, want %s", hash, blob[len(blobMagic)], codec)
+		}
+	}
+}
+
+func TestSpawnSurvivesPanics(t *testing.T) {
+	n := new(Node)
+
+	ran := make(chan struct{})
+	n.spawn("panicking", func() { panic("boom") })
+	n.spawn("working", func() { close(ran) })
+
+	n.goroutines.Wait()
+	select {
+		case <-ran:
+		default:
+			t.Fatal("task did not run")
+	}
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// replicationState tracks the progress of replication rounds, at most one runs at a time
+type replicationState struct {
+	lock sync.Mutex
+
+	running bool
+	lastStarted time.Time
+	lastFinished time.Time
+
+	// files the current (or last) round set out to send, summed over replicas
+	queued int
+	sentFiles int
+	sentBytes int64
+	failures int
+	lastError string
+}
+
+// start claims the round, false while another round is still running
+func (s *replicationState) start() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.running {
+		return false
+	}
+
+	s.running = true
+	s.lastStarted = time.Now()
+	s.queued = 0
+
+	return true
+}
+
+func (s *replicationState) finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.running = false
+	s.lastFinished = time.Now()
+}
+
+func (s *replicationState) queue(files int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.queued += files
+}
+
+func (s *replicationState) sent(files int, bytes int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sentFiles += files
+	s.sentBytes += int64(bytes)
+}
+
+func (s *replicationState) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.failures++
+	s.lastError = err.Error()
+}
+
+// replicaState tracks which committed files and trees one replica of this primary holds
+type replicaState struct {
+	files map[string]struct{}
+	trees map[string]struct{}
+
+	// the replica's budget ran out before it got every file
+	full bool
+}
+
+func newReplicaState() *replicaState {
+	return &replicaState{
+		files: make(map[string]struct{}),
+		trees: make(map[string]struct{}),
+	}
+}
+
+// the marriage helpers below are called with n.lock held
+
+// wantsReplicas tells whether this primary has fewer than replication_factor - 1
+// replicas, or needs an overflow replica for files its full replicas can't take.
+// Outgoing proposals count as replicas until they are confirmed or rolled back.
+func (n *Node) wantsReplicas() bool {
+	return n.openSlots() > 0
+}
+
+// openSlots counts the replicas still wanted, overflow replicas are recruited one at a time
+func (n *Node) openSlots() int {
+	if !n.isPrimary || n.config.Redundancy != RedundancyMarriage {
+		return 0
+	}
+
+	slots := len(n.replicas) + len(n.proposals)
+	if slots < n.config.ReplicationFactor - 1 {
+		return n.config.ReplicationFactor - 1 - slots
+	}
+
+	if slots >= n.config.ReplicationFactor - 1 + n.config.OverflowReplicas {
+		return 0
+	}
+
+	for _, r := range n.replicas {
+		if r.full {
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// partners lists the replicas of a primary or the primary of a married replica
+func (n *Node) partners() []string {
+	if !n.isPrimary {
+		if n.maritalStatus && n.marriedTo != "" {
+			return []string{n.marriedTo}
+		}
+		return nil
+	}
+
+	ids := make([]string, 0, len(n.replicas))
+	for id := range n.replicas {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+func (n *Node) isPartner(id string) bool {
+	if n.isPrimary {
+		_, ok := n.replicas[id]
+		return ok
+	}
+
+	return n.maritalStatus && n.marriedTo == id
+}
+
+func (n *Node) addReplica(id string) {
+	n.replicas[id] = newReplicaState()
+	n.maritalStatus = true
+}
+
+// removeReplica forgets a dead replica, files it held are no longer fully
+// replicated until a replacement has received them
+func (n *Node) removeReplica(id string) {
+	delete(n.replicas, id)
+	n.maritalStatus = len(n.replicas) > 0
+
+	for hash, status := range n.fileStatusTable {
+		if status == 2 && n.copies(hash) < n.config.ReplicationFactor - 1 {
+			n.fileStatusTable[hash] = 1
+		}
+	}
+	for root, status := range n.treesStatus {
+		if status == 2 && len(n.replicas) < n.config.ReplicationFactor - 1 {
+			n.treesStatus[root] = 0
+		}
+	}
+
+	fmt.Printf("%d of %d replicas left\n", len(n.replicas), n.config.ReplicationFactor - 1)
+}
+
+// copies counts the replicas holding hash
+func (n *Node) copies(hash string) int {
+	count := 0
+	for _, r := range n.replicas {
+		if _, ok := r.files[hash]; ok {
+			count++
+		}
+	}
+
+	return count
+}
+
+// markFileReplicated records that replica holds hash, the file is fully
+// replicated once replication_factor - 1 replicas do. Overflow replicas
+// make up for full ones, so these need not be the same for every file.
+func (n *Node) markFileReplicated(replica string, hash string) {
+	r, ok := n.replicas[replica]
+	if !ok {
+		return
+	}
+	r.files[hash] = struct{}{}
+
+	if n.copies(hash) >= n.config.ReplicationFactor - 1 {
+		n.fileStatusTable[hash] = 2
+	}
+}
+
+func (n *Node) markTreeReplicated(replica string, root string) {
+	r, ok := n.replicas[replica]
+	if !ok {
+		return
+	}
+	r.trees[root] = struct{}{}
+
+	if len(n.replicas) < n.config.ReplicationFactor - 1 {
+		return
+	}
+	for _, other := range n.replicas {
+		if _, ok := other.trees[root]; !ok {
+			return
+		}
+	}
+
+	n.treesStatus[root] = 2
+}
+
+// unacknowledgeFile forgets that replica holds hash, so it is replicated again
+func (n *Node) unacknowledgeFile(replica string, hash string) {
+	if r, ok := n.replicas[replica]; ok {
+		delete(r.files, hash)
+	}
+
+	if n.fileStatusTable[hash] == 2 && n.copies(hash) < n.config.ReplicationFactor - 1 {
+		n.fileStatusTable[hash] = 1
+	}
+}
+
+func (n *Node) unacknowledgeTree(replica string, root string) {
+	if r, ok := n.replicas[replica]; ok {
+		delete(r.trees, root)
+	}
+
+	if n.treesStatus[root] == 2 {
+		n.treesStatus[root] = 0
+	}
+}
+
+// redundancyRatio is the share of committed files held by replication_factor - 1 replicas
+func (n *Node) redundancyRatio() (committed int, replicated int, ratio float64) {
+	for _, status := range n.fileStatusTable {
+		if status == 0 {
+			continue
+		}
+
+		committed++
+		if status == 2 {
+			replicated++
+		}
+	}
+
+	if committed == 0 {
+		return 0, 0, 1
+	}
+
+	return committed, replicated, float64(replicated) / float64(committed)
+}
+
+// ReplicationStatus tells operators how much of this primary's data is unprotected
+// and how replication is progressing
+func (n *Node) ReplicationStatus(args *ReplicationStatusArgs, reply *ReplicationStatusReply) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if !n.isPrimary {
+		return errors.New("Only primaries replicate")
+	}
+
+	reply.ReplicationFactor = n.config.ReplicationFactor
+
+	s := &n.replicationState
+	s.lock.Lock()
+	reply.Running = s.running
+	reply.LastStarted = s.lastStarted
+	reply.LastFinished = s.lastFinished
+	reply.Queued = s.queued
+	reply.SentFiles = s.sentFiles
+	reply.SentBytes = s.sentBytes
+	reply.Failures = s.failures
+	reply.LastError = s.lastError
+	s.lock.Unlock()
+
+	reply.Committed, reply.Replicated, reply.RedundancyRatio = n.redundancyRatio()
+
+	for hash, status := range n.fileStatusTable {
+		if status == 1 {
+			reply.Unreplicated = append(reply.Unreplicated, hash)
+		}
+	}
+	sort.Strings(reply.Unreplicated)
+
+	for _, id := range n.partners() {
+		status := ReplicaStatus{
+			ID: id,
+			Files: len(n.replicas[id].files),
+			Trees: len(n.replicas[id].trees),
+			Full: n.replicas[id].full,
+		}
+		if peer, ok := n.peerTable[id]; ok {
+			status.Address = peer.address
+		}
+
+		reply.Replicas = append(reply.Replicas, status)
+	}
+
+	return nil
+}
@@ -1,11 +1,26 @@
 package main
 
+import "time"
+
 type HeartBeatArgs struct {
 	Sender string
 	Address string
 	IsPrimary bool
 	MaritalStatus bool
 	MarriedTo string
+	// proposal the sender's marriage was confirmed with, "" for marriages through Rejoin
+	ProposalID string
+	Compressions []string
+	// marriage lineage and term, see fence
+	Lineage string
+	Term uint64
+	// the sender's incarnation and membership deltas, see MemberUpdate
+	Incarnation uint64
+	Updates []MemberUpdate
+	// failure domain, free budget and requests being served, see PartnerSelector
+	Zone string
+	FreeBudget int
+	Load int
 }
 
 type HeartBeatReply struct {
@@ -13,11 +28,21 @@ type HeartBeatReply struct {
 	IsPrimary bool
 	MaritalStatus bool
 	MarriedTo string
+	Compressions []string
+	Lineage string
+	Term uint64
+	Incarnation uint64
+	Updates []MemberUpdate
+	Zone string
+	FreeBudget int
+	Load int
 }
 
 type UploadRequestArgs struct {
 	RequiredBudget int
 	RequesterID string
+	// codec the booked files are stored with, empty uses the node default
+	Compression string
 }
 
 type UploadRequestReply struct {
@@ -27,7 +52,9 @@ type UploadRequestReply struct {
 
 type UploadFilesArgs struct {
 	RequesterID string
+	// contents are compressed with Compression, hashes are over the uncompressed contents
 	Files map[string]string
+	Compression string
 }
 
 type UploadFilesReply struct {
@@ -48,11 +75,13 @@ type CommitFilesReply struct {
 type DownloadFileArgs struct {
 	Merkle string
 	Index int
+	AcceptCompression []string
 }
 
 type DownloadFileReply struct {
 	Proof []string
 	Content string
+	Compression string
 }
 
 type ReplicateMerkleArgs struct {
@@ -66,9 +95,242 @@ type ReplicateMerkleReply struct {
 }
 
 type ProposeArgs struct {
+	ProposalID string
 	Proposer string
+	Lineage string
+	Term uint64
 }
 
 type ProposeReply struct {
 	Granted bool
-}
\ No newline at end of file
+}
+
+type ConfirmProposalArgs struct {
+	ProposalID string
+	Proposer string
+}
+
+type ConfirmProposalReply struct {
+	Confirmed bool
+}
+
+type CancelProposalArgs struct {
+	ProposalID string
+	Proposer string
+}
+
+type CancelProposalReply struct {
+}
+
+type FetchFileArgs struct {
+	RequesterID string
+	Hash string
+	AcceptCompression []string
+}
+
+type FetchFileReply struct {
+	Content string
+	Compression string
+}
+
+type ScrubStatusArgs struct {
+}
+
+type ScrubStatusReply struct {
+	Running bool
+	LastStarted time.Time
+	LastFinished time.Time
+	Scanned int
+	Total int
+	// findings of the current (or last) run that are not repaired yet
+	Corrupted []string
+	Missing []string
+	Repaired []string
+}
+
+type NodeInfoArgs struct {
+}
+
+type NodeInfoReply struct {
+	ID string
+	Address string
+	IsPrimary bool
+	MaritalStatus bool
+	MarriedTo string
+	PartnerAddress string
+	// every partner, the replicas of a primary or the primary of a replica
+	Partners []string
+	PartnerAddresses []string
+	Compressions []string
+}
+
+type StoreShardArgs struct {
+	RequesterID string
+	// file the shard belongs to
+	FileHash string
+	Index int
+	Content string
+	// where every shard of the file goes, kept by every holder so any node can rebuild the file
+	Placement *ShardPlacement
+	// index maps of the trees holding the file, so holders can serve it without the primary
+	Trees map[string]map[string]int
+}
+
+type StoreShardReply struct {
+	Hash string
+}
+
+type DropShardArgs struct {
+	RequesterID string
+	FileHash string
+	Index int
+}
+
+type DropShardReply struct {
+}
+
+type FetchShardArgs struct {
+	RequesterID string
+	Hash string
+}
+
+type FetchShardReply struct {
+	Content string
+}
+
+type FetchPlacementArgs struct {
+	RequesterID string
+	FileHash string
+}
+
+type FetchPlacementReply struct {
+	Placement *ShardPlacement
+}
+
+type ReplicationStatusArgs struct {
+}
+
+type ReplicaStatus struct {
+	ID string
+	Address string
+	Files int
+	Trees int
+	// ran out of budget before receiving every file
+	Full bool
+}
+
+type ReplicationStatusReply struct {
+	ReplicationFactor int
+	// committed files and the ones held by replication_factor - 1 replicas
+	Committed int
+	Replicated int
+	RedundancyRatio float64
+	Unreplicated []string
+	Replicas []ReplicaStatus
+
+	// progress of the current or last replication round
+	Running bool
+	LastStarted time.Time
+	LastFinished time.Time
+	Queued int
+	// totals since the node started
+	SentFiles int
+	SentBytes int64
+	Failures int
+	LastError string
+}
+
+type SyncArgs struct {
+	RequesterID string
+	// SyncFiles or SyncTrees
+	Kind string
+	Prefixes []string
+	// list the hashes of every prefix instead of summarizing them
+	List bool
+}
+
+type SyncReply struct {
+	Summaries []RangeSummary
+	Hashes [][]string
+}
+
+type FetchTreeArgs struct {
+	RequesterID string
+	Merkle string
+}
+
+type FetchTreeReply struct {
+	IndexMap map[string]int
+}
+
+type Event struct {
+	Seq int
+	Time time.Time
+	// EventPromoted, EventMarried or EventPartnerDied
+	Kind string
+	NodeID string
+	Detail string
+}
+
+type EventsArgs struct {
+	// first sequence number wanted, 0 returns every event still kept
+	Since int
+}
+
+type EventsReply struct {
+	Events []Event
+	// pass as Since to get only newer events
+	Next int
+}
+
+type RejoinArgs struct {
+	RequesterID string
+	Lineage string
+	// the stale term the requester was primary in
+	Term uint64
+}
+
+type RejoinReply struct {
+	Granted bool
+	Term uint64
+}
+
+type ProbeArgs struct {
+	RequesterID string
+	Target string
+	Address string
+}
+
+type ProbeReply struct {
+	Reached bool
+}
+
+type PingArgs struct {
+	Sender string
+}
+
+type PingReply struct {
+	Receiver string
+}
+
+type PeersArgs struct {
+}
+
+type PeerStatus struct {
+	ID string
+	Address string
+	IsPrimary bool
+	MaritalStatus bool
+	// PeerAlive, PeerSuspect or PeerDead
+	State string
+	Phi float64
+	LastHeartBeat time.Time
+	Zone string
+	FreeBudget int
+	Load int
+	Latency time.Duration
+}
+
+type PeersReply struct {
+	Peers []PeerStatus
+}
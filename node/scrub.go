@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// scrubState tracks the progress and findings of the background scrubber
+type scrubState struct {
+	lock sync.Mutex
+
+	running bool
+	lastStarted time.Time
+	lastFinished time.Time
+	scanned int
+	total int
+
+	corrupted map[string]struct{}
+	missing map[string]struct{}
+	repaired map[string]struct{}
+}
+
+func (s *scrubState) start(total int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.running = true
+	s.lastStarted = time.Now()
+	s.scanned = 0
+	s.total = total
+	s.corrupted = make(map[string]struct{})
+	s.missing = make(map[string]struct{})
+	s.repaired = make(map[string]struct{})
+}
+
+func (s *scrubState) finish() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.running = false
+	s.lastFinished = time.Now()
+}
+
+func (s *scrubState) record(hash string, corrupted bool, missing bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.scanned++
+	if corrupted {
+		s.corrupted[hash] = struct{}{}
+	}
+	if missing {
+		s.missing[hash] = struct{}{}
+	}
+}
+
+func (s *scrubState) markRepaired(hash string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.corrupted, hash)
+	delete(s.missing, hash)
+	s.repaired[hash] = struct{}{}
+}
+
+// runScrubber rehashes every stored blob once per scrub interval until ctx is cancelled
+func (n *Node) runScrubber(ctx context.Context) {
+	ticker := time.NewTicker(n.config.ScrubInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <-ticker.C:
+				n.scrub(ctx)
+			case <-ctx.Done():
+				return
+		}
+	}
+}
+
+// scrub checks every stored blob against its filename and every tree leaf
+// against the store. Corrupted or missing blobs are fetched from a married
+// partner when scrub_repair is set.
+func (n *Node) scrub(ctx context.Context) {
+	err, stored := n.store.List()
+	if err != nil {
+		fmt.Printf("Scrub failed listing blobs: %s\n", err)
+		return
+	}
+
+	// leaves of committed trees must exist unless they are erasure coded,
+	// plain blobs must match their name
+	expected := make(map[string]struct{})
+	n.lock.Lock()
+	for _, t := range n.trees {
+		for _, hash := range t.indexToHash {
+			if !n.isSharded(hash) {
+				expected[hash] = struct{}{}
+			}
+		}
+	}
+	n.lock.Unlock()
+
+	hashes := make(map[string]struct{}, len(stored) + len(expected))
+	for _, hash := range stored {
+		hashes[hash] = struct{}{}
+	}
+	for hash := range expected {
+		hashes[hash] = struct{}{}
+	}
+
+	ordered := make([]string, 0, len(hashes))
+	for hash := range hashes {
+		ordered = append(ordered, hash)
+	}
+	sort.Strings(ordered)
+
+	fmt.Printf("Scrubbing %d blobs\n", len(ordered))
+	n.scrubState.start(len(ordered))
+	defer n.scrubState.finish()
+
+	for _, hash := range ordered {
+		if ctx.Err() != nil {
+			return
+		}
+
+		err, content := n.readBlob(hash)
+		if errors.Is(err, ErrBlobNotFound) {
+			_, isLeaf := expected[hash]
+			n.scrubState.record(hash, false, isLeaf)
+			if !isLeaf {
+				continue
+			}
+			fmt.Printf("Scrub found missing blob %s\n", hash)
+		} else if err != nil {
+			fmt.Printf("Scrub failed reading %s: %s\n", hash, err)
+			n.scrubState.record(hash, false, false)
+			continue
+		} else if ComputeHash(string(content)) != hash {
+			fmt.Printf("Scrub found corrupted blob %s\n", hash)
+			n.scrubState.record(hash, true, false)
+		} else {
+			n.scrubState.record(hash, false, false)
+			continue
+		}
+
+		if !n.config.ScrubRepair {
+			continue
+		}
+
+		if err := n.repairBlob(ctx, hash); err != nil {
+			fmt.Printf("Could not repair %s: %s\n", hash, err)
+			continue
+		}
+
+		fmt.Printf("Repaired %s\n", hash)
+		n.scrubState.markRepaired(hash)
+	}
+
+	fmt.Printf("Scrub finished\n")
+}
+
+// repairBlob replaces the local copy of hash with a married partner's copy,
+// or one rebuilt from its shards in erasure mode
+func (n *Node) repairBlob(ctx context.Context, hash string) error {
+	err, content := n.recoverBlob(ctx, hash)
+	if err != nil {
+		return err
+	}
+
+	// repaired with the codec it was stored with
+	n.lock.Lock()
+	codec := n.fileCodec(hash)
+	n.lock.Unlock()
+
+	return n.writeBlob(hash, content, codec)
+}
+
+// fetchFromPartner downloads the blob hash from the first partner holding a good copy
+func (n *Node) fetchFromPartner(ctx context.Context, hash string) (err error, content string) {
+	n.lock.Lock()
+	partners := n.partners()
+	n.lock.Unlock()
+
+	if len(partners) == 0 {
+		return errors.New("Not married, no partner to fetch from"), ""
+	}
+
+	var errs []error
+	for _, id := range partners {
+		err, content := n.fetchFrom(ctx, id, hash)
+		if err == nil {
+			return nil, content
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w", id, err))
+	}
+
+	return errors.Join(errs...), ""
+}
+
+func (n *Node) fetchFrom(ctx context.Context, partner string, hash string) (err error, content string) {
+	err, address := n.peerAddress(partner)
+	if err != nil {
+		return err, ""
+	}
+
+	args := FetchFileArgs{
+		RequesterID: n.id,
+		Hash: hash,
+		AcceptCompression: n.wireCompressions(),
+	}
+	var reply FetchFileReply
+
+	ctx, cancel := context.WithTimeout(ctx, n.config.TransferTimeout)
+	defer cancel()
+
+	if err := call(ctx, address, "Node.FetchFile", &args, &reply); err != nil {
+		return err, ""
+	}
+
+	err, decompressed := decompress(reply.Compression, []byte(reply.Content))
+	if err != nil {
+		return err, ""
+	}
+
+	if ComputeHash(string(decompressed)) != hash {
+		return errors.New("Partner's copy is corrupted as well"), ""
+	}
+
+	return nil, string(decompressed)
+}
+
+// FetchFile hands a verified copy of a blob to a married partner
+func (n *Node) FetchFile(args *FetchFileArgs, reply *FetchFileReply) error {
+	n.lock.Lock()
+	partner := n.isPartner(args.RequesterID)
+	n.lock.Unlock()
+
+	if !partner {
+		return errors.New("Not my partner!")
+	}
+
+	err, content := n.readBlob(args.Hash)
+	if errors.Is(err, ErrBlobNotFound) {
+		return errors.New("File is missing on this node")
+	} else if err != nil {
+		fmt.Printf("Error reading file: %s\n", err)
+		return errors.New("Error reading file")
+	}
+
+	// never hand out a bad copy, the partner would just store it again
+	if ComputeHash(string(content)) != args.Hash {
+		return errors.New("File corrupted on this node as well")
+	}
+
+	reply.Compression = CompressionNone
+	if n.config.WireCompression {
+		reply.Compression = negotiateCompression(args.AcceptCompression)
+	}
+
+	err, compressed := compress(reply.Compression, content)
+	if err != nil {
+		return errors.New("Error compressing file")
+	}
+
+	reply.Content = string(compressed)
+
+	return nil
+}
+
+// ScrubStatus exposes the progress and findings of the current or last scrub
+func (n *Node) ScrubStatus(args *ScrubStatusArgs, reply *ScrubStatusReply) error {
+	s := &n.scrubState
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	reply.Running = s.running
+	reply.LastStarted = s.lastStarted
+	reply.LastFinished = s.lastFinished
+	reply.Scanned = s.scanned
+	reply.Total = s.total
+	reply.Corrupted = sortedKeys(s.corrupted)
+	reply.Missing = sortedKeys(s.missing)
+	reply.Repaired = sortedKeys(s.repaired)
+
+	return nil
+}
+
+func sortedKeys(m map[string]struct{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
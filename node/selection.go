@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	SelectionScored = "scored"
+	SelectionCapacity = "capacity"
+	SelectionLatency = "latency"
+	SelectionRandom = "random"
+)
+
+var partnerSelections = []string{SelectionScored, SelectionCapacity, SelectionLatency, SelectionRandom}
+
+// Candidate is an unmarried peer a primary may propose to, as far as its heartbeats tell
+type Candidate struct {
+	ID string
+	// failure domain, "" if the peer has none
+	Zone string
+	// files the peer can still take
+	FreeBudget int
+	// requests the peer is serving
+	Load int
+	// smoothed heartbeat round trip, 0 until measured
+	Latency time.Duration
+}
+
+// PartnerSelector orders the candidates of a primary holding needed files, best
+// first. Whatever the order, candidates sharing a failure domain with the primary
+// or its partners are never proposed to while the cluster spans a failure domain
+// per copy, with fewer domains only once no other candidate is left.
+type PartnerSelector interface {
+	Name() string
+	Rank(needed int, candidates []Candidate) []Candidate
+}
+
+func newPartnerSelector(name string) PartnerSelector {
+	switch name {
+		case SelectionCapacity:
+			return capacitySelector{}
+		case SelectionLatency:
+			return latencySelector{}
+		case SelectionRandom:
+			return randomSelector{}
+	}
+
+	return scoredSelector{}
+}
+
+// scoredSelector puts the candidates that can hold all of the primary's files first
+// and weighs free capacity, load and latency relative to the other candidates
+type scoredSelector struct{}
+
+func (scoredSelector) Name() string {
+	return SelectionScored
+}
+
+func (scoredSelector) Rank(needed int, candidates []Candidate) []Candidate {
+	var maxFree, maxLoad int
+	var minLatency time.Duration
+	for _, c := range candidates {
+		maxFree = max(maxFree, c.FreeBudget)
+		maxLoad = max(maxLoad, c.Load)
+		if c.Latency > 0 && (minLatency == 0 || c.Latency < minLatency) {
+			minLatency = c.Latency
+		}
+	}
+
+	score := func(c Candidate) float64 {
+		s := 0.0
+		if maxFree > 0 {
+			s += 0.5 * float64(max(c.FreeBudget, 0)) / float64(maxFree)
+		}
+		if maxLoad > 0 {
+			s += 0.25 * (1 - float64(c.Load) / float64(maxLoad))
+		} else {
+			s += 0.25
+		}
+		// unmeasured peers get nothing for latency
+		if c.Latency > 0 {
+			s += 0.25 * float64(minLatency) / float64(c.Latency)
+		}
+		return s
+	}
+
+	ranked := append([]Candidate(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		fitsI, fitsJ := ranked[i].FreeBudget >= needed, ranked[j].FreeBudget >= needed
+		if fitsI != fitsJ {
+			return fitsI
+		}
+		return score(ranked[i]) > score(ranked[j])
+	})
+
+	return ranked
+}
+
+// capacitySelector prefers the candidates with the most free budget
+type capacitySelector struct{}
+
+func (capacitySelector) Name() string {
+	return SelectionCapacity
+}
+
+func (capacitySelector) Rank(needed int, candidates []Candidate) []Candidate {
+	ranked := append([]Candidate(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].FreeBudget > ranked[j].FreeBudget
+	})
+
+	return ranked
+}
+
+// latencySelector prefers the nearest candidates, unmeasured ones come last
+type latencySelector struct{}
+
+func (latencySelector) Name() string {
+	return SelectionLatency
+}
+
+func (latencySelector) Rank(needed int, candidates []Candidate) []Candidate {
+	ranked := append([]Candidate(nil), candidates...)
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if (ranked[i].Latency == 0) != (ranked[j].Latency == 0) {
+			return ranked[j].Latency == 0
+		}
+		return ranked[i].Latency < ranked[j].Latency
+	})
+
+	return ranked
+}
+
+// randomSelector ignores everything but failure domains
+type randomSelector struct{}
+
+func (randomSelector) Name() string {
+	return SelectionRandom
+}
+
+func (randomSelector) Rank(needed int, candidates []Candidate) []Candidate {
+	ranked := append([]Candidate(nil), candidates...)
+	rand.Shuffle(len(ranked), func(i, j int) {
+		ranked[i], ranked[j] = ranked[j], ranked[i]
+	})
+
+	return ranked
+}
+
+// spreadZones moves the candidates of a failure domain already taken behind the others
+func spreadZones(ranked []Candidate, taken map[string]bool) []Candidate {
+	spread := make([]Candidate, 0, len(ranked))
+	for _, c := range ranked {
+		if !taken[c.Zone] {
+			spread = append(spread, c)
+		}
+	}
+	for _, c := range ranked {
+		if taken[c.Zone] {
+			spread = append(spread, c)
+		}
+	}
+
+	return spread
+}
+
+// describe records the placement details the peer advertised in a heartbeat
+func (p *Peer) describe(zone string, freeBudget int, load int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.zone = zone
+	p.freeBudget = freeBudget
+	p.load = load
+	p.described = true
+}
+
+// measured folds a heartbeat round trip into the peer's latency
+func (p *Peer) measured(rtt time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.latency == 0 {
+		p.latency = rtt
+		return
+	}
+	p.latency = (7 * p.latency + rtt) / 8
+}
+
+// candidate describes the peer to a PartnerSelector, false if it can't be proposed to.
+// Peers only known through gossip wait for their first heartbeat, until then their
+// zone and budget are unknown and they would pass for a safe, empty failure domain.
+func (p *Peer) candidate(id string) (Candidate, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.isPrimary || p.maritalStatus || p.state != PeerAlive || !p.described {
+		return Candidate{}, false
+	}
+
+	return Candidate{
+		ID: id,
+		Zone: p.zone,
+		FreeBudget: p.freeBudget,
+		Load: p.load,
+		Latency: p.latency,
+	}, true
+}
+
+// the Node methods below are called with n.lock held
+
+// selectPartners picks the peers to propose to for every open replica slot, one
+// at a time so each pick sees the failure domains the previous ones took
+func (n *Node) selectPartners(peers map[string]*Peer) []Candidate {
+	needed := 0
+	for _, status := range n.fileStatusTable {
+		if status != 0 {
+			needed++
+		}
+	}
+
+	taken := make(map[string]bool)
+	for _, id := range append(n.partners(), n.proposed()...) {
+		if peer, ok := n.peerTable[id]; ok {
+			peer.lock.Lock()
+			taken[peer.zone] = true
+			peer.lock.Unlock()
+		}
+	}
+	taken[n.config.Zone] = true
+	// peers without a zone share no known failure domain
+	delete(taken, "")
+
+	// a failure domain per copy among the possible replicas makes the zone rule
+	// hard, peers of the free ones may just be busy. Fewer make it a preference,
+	// a replica sharing a domain beats none at all.
+	zones := make(map[string]bool)
+	zones[n.config.Zone] = true
+	for _, peer := range n.peerTable {
+		peer.lock.Lock()
+		if peer.state == PeerAlive && peer.described && !peer.isPrimary {
+			zones[peer.zone] = true
+		}
+		peer.lock.Unlock()
+	}
+	delete(zones, "")
+	strict := len(zones) >= n.config.ReplicationFactor
+
+	var candidates []Candidate
+	for id, peer := range peers {
+		if _, ok := n.replicas[id]; ok {
+			continue
+		}
+		if _, ok := n.proposals[id]; ok {
+			continue
+		}
+		if c, ok := peer.candidate(id); ok {
+			candidates = append(candidates, c)
+		}
+	}
+
+	var chosen []Candidate
+	for slots := n.openSlots(); len(chosen) < slots && len(candidates) > 0; {
+		ranked := spreadZones(n.selector.Rank(needed, candidates), taken)
+		best := ranked[0]
+		if taken[best.Zone] && strict {
+			fmt.Printf("Only peers of taken failure domains are left, waiting for a peer of another one of the %d\n", len(zones))
+			break
+		}
+		if taken[best.Zone] {
+			fmt.Printf("Only peers of taken failure domains are left, %s shares %s\n", best.ID, best.Zone)
+		}
+
+		chosen = append(chosen, best)
+		if best.Zone != "" {
+			taken[best.Zone] = true
+		}
+		candidates = ranked[1:]
+	}
+
+	return chosen
+}
+
+func (n *Node) proposed() []string {
+	ids := make([]string, 0, len(n.proposals))
+	for id := range n.proposals {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// countLoad counts the requests being served, heartbeats advertise it as the node's load
+func (n *Node) countLoad(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.load.Add(1)
+		defer n.load.Add(-1)
+
+		next.ServeHTTP(w, r)
+	})
+}
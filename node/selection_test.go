@@ -0,0 +1,143 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGossipOnlyPeersAreNotProposedTo(t *testing.T) {
+	config := defaultConfig()
+	config.Primary = true
+	config.StorageBackend = "memory"
+	config.DiscoveryMulticast = false
+	config.Zone = "a"
+	config.PartnerSelection = SelectionCapacity
+
+	n := new(Node)
+	if err := n.init("127.0.0.1:0", config); err != nil {
+		t.Fatal(err)
+	}
+
+	// learned through gossip, its zone looks empty and so unshared
+	rumoured := newPeer("127.0.0.1:1")
+	rumoured.learn(false, false, nil, 1)
+
+	// heartbeated, sharing our zone
+	described := newPeer("127.0.0.1:2")
+	described.learn(false, false, nil, 1)
+	described.describe("a", 10, 0)
+
+	n.lock.Lock()
+	n.peerTable["rumoured"] = rumoured
+	n.peerTable["described"] = described
+	chosen := n.selectPartners(map[string]*Peer{"rumoured": rumoured, "described": described})
+	n.lock.Unlock()
+
+	if len(chosen) != 1 || chosen[0].ID != "described" {
+		t.Fatalf("chose %v, want only the described peer", chosen)
+	}
+
+	// once it heartbeated another zone it is preferred like anyone else
+	rumoured.describe("c", 1, 0)
+	n.lock.Lock()
+	chosen = n.selectPartners(map[string]*Peer{"rumoured": rumoured, "described": described})
+	n.lock.Unlock()
+
+	if len(chosen) != 1 || chosen[0].ID != "rumoured" {
+		t.Fatalf("chose %v, want the peer of the other zone", chosen)
+	}
+}
+
+func TestCapacitySelectorPrefersFreeBudget(t *testing.T) {
+	ranked := capacitySelector{}.Rank(5, []Candidate{
+		{ID: "small", FreeBudget: 2},
+		{ID: "large", FreeBudget: 50},
+		{ID: "medium", FreeBudget: 10, Latency: time.Millisecond},
+	})
+
+	if got := candidateIDs(ranked); got != "large medium small" {
+		t.Fatalf("ranked %s", got)
+	}
+}
+
+func TestLatencySelectorPutsUnmeasuredPeersLast(t *testing.T) {
+	ranked := latencySelector{}.Rank(5, []Candidate{
+		{ID: "unmeasured", FreeBudget: 100},
+		{ID: "far", Latency: 50 * time.Millisecond},
+		{ID: "near", Latency: time.Millisecond},
+	})
+
+	if got := candidateIDs(ranked); got != "near far unmeasured" {
+		t.Fatalf("ranked %s", got)
+	}
+}
+
+func TestRandomSelectorShufflesEveryCandidate(t *testing.T) {
+	candidates := []Candidate{{ID: "a"}, {ID: "b"}, {ID: "c"}, {ID: "d"}}
+
+	firsts := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		ranked := randomSelector{}.Rank(1, candidates)
+
+		ids := strings.Fields(candidateIDs(ranked))
+		sort.Strings(ids)
+		if strings.Join(ids, " ") != "a b c d" {
+			t.Fatalf("ranked %v", ids)
+		}
+		firsts[ranked[0].ID] = true
+	}
+
+	if len(firsts) < 2 {
+		t.Fatalf("%v came first every time", firsts)
+	}
+}
+
+func TestSharedZonesWaitWhileEnoughZonesExist(t *testing.T) {
+	config := defaultConfig()
+	config.Primary = true
+	config.StorageBackend = "memory"
+	config.DiscoveryMulticast = false
+	config.Zone = "a"
+
+	n := new(Node)
+	if err := n.init("127.0.0.1:0", config); err != nil {
+		t.Fatal(err)
+	}
+
+	// the only unmarried peer shares our zone
+	neighbour := newPeer("127.0.0.1:1")
+	neighbour.learn(false, false, nil, 1)
+	neighbour.describe("a", 10, 0)
+
+	// the peer of another zone is married for now
+	busy := newPeer("127.0.0.1:2")
+	busy.learn(false, true, nil, 1)
+	busy.describe("b", 10, 0)
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.peerTable["neighbour"] = neighbour
+	n.peerTable["busy"] = busy
+
+	// two zones hold both copies, better wait for zone b
+	if chosen := n.selectPartners(n.peerTable); len(chosen) != 0 {
+		t.Fatalf("chose %v, want to wait for a peer of zone b", chosen)
+	}
+
+	// three copies can't all be spread, sharing a zone beats no replica
+	n.config.ReplicationFactor = 3
+	if chosen := n.selectPartners(n.peerTable); len(chosen) != 1 || chosen[0].ID != "neighbour" {
+		t.Fatalf("chose %v, want the neighbour", chosen)
+	}
+}
+
+func candidateIDs(candidates []Candidate) string {
+	var ids []string
+	for _, c := range candidates {
+		ids = append(ids, c.ID)
+	}
+
+	return strings.Join(ids, " ")
+}
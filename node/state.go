@@ -0,0 +1,262 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// nodeState is what a node keeps across restarts: its id (which also names
+// its blobs), role, trees, file states and what every replica acknowledged
+type nodeState struct {
+	ID string `json:"id"`
+	// the role the node had last, nil in states saved before roles were kept
+	IsPrimary *bool `json:"is_primary,omitempty"`
+	FileBudget int `json:"file_budget"`
+	Files map[string]int `json:"files"`
+	FileCodecs map[string]string `json:"file_codecs,omitempty"`
+	FileOwners map[string]string `json:"file_owners,omitempty"`
+	// leaf positions of every tree, enough to rebuild it
+	Trees map[string]map[string]int `json:"trees"`
+	TreesStatus map[string]int `json:"trees_status"`
+	Shards map[string]*ShardPlacement `json:"shards,omitempty"`
+	// unused bookings and the codec they store with, requesters upload into them after a restart
+	Bookings map[string]int `json:"bookings,omitempty"`
+	BookingCodecs map[string]string `json:"booking_codecs,omitempty"`
+
+	MarriedTo string `json:"married_to,omitempty"`
+	// confirmed proposal of the marriage, a primary cancelling it is recognised after a restart
+	ProposalID string `json:"proposal_id,omitempty"`
+	Lineage string `json:"lineage"`
+	Term uint64 `json:"term"`
+	Replicas map[string]*persistedReplica `json:"replicas,omitempty"`
+	// addresses of the partners, so they are heartbeated before anyone rediscovers them
+	Partners map[string]string `json:"partners,omitempty"`
+}
+
+type persistedReplica struct {
+	Files []string `json:"files"`
+	Trees []string `json:"trees"`
+	Full bool `json:"full,omitempty"`
+}
+
+// saveState writes the node state through a temp file, so a crash leaves the
+// previous state intact. It snapshots under n.lock, callers must not hold it.
+// Concurrent saves are batched, a save waiting for the write in progress is
+// done once a later write took in its changes.
+func (n *Node) saveState() error {
+	if n.statePath == "" {
+		return nil
+	}
+
+	// our changes are made, any snapshot from now on holds them
+	wanted := n.stateWanted.Add(1)
+
+	n.stateLock.Lock()
+	defer n.stateLock.Unlock()
+
+	if n.stateWritten.Load() >= wanted {
+		return nil
+	}
+	covered := n.stateWanted.Load()
+
+	err, dat := n.snapshotState()
+	if err != nil {
+		fmt.Printf("Error encoding state: %s\n", err)
+		return err
+	}
+
+	if err := n.writeState(dat); err != nil {
+		return err
+	}
+	n.stateWritten.Store(covered)
+
+	return nil
+}
+
+// snapshotState encodes the node state while holding n.lock
+func (n *Node) snapshotState() (err error, dat []byte) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	isPrimary := n.isPrimary
+	state := nodeState{
+		ID: n.id,
+		IsPrimary: &isPrimary,
+		FileBudget: n.fileBudget,
+		Files: n.fileStatusTable,
+		FileCodecs: n.fileCodecs,
+		FileOwners: n.fileOwners,
+		Trees: make(map[string]map[string]int, len(n.trees)),
+		TreesStatus: n.treesStatus,
+		Lineage: n.lineage,
+		Term: n.term,
+		Shards: n.shardPlacements,
+		Bookings: n.fileBookings,
+		BookingCodecs: n.bookingCompression,
+		Replicas: make(map[string]*persistedReplica, len(n.replicas)),
+		Partners: make(map[string]string),
+	}
+
+	if !n.isPrimary && n.maritalStatus {
+		state.MarriedTo = n.marriedTo
+		state.ProposalID = n.proposalID
+	}
+
+	for root, t := range n.trees {
+		state.Trees[root] = t.hashToIndex
+	}
+
+	for id, r := range n.replicas {
+		state.Replicas[id] = &persistedReplica{
+			Files: sortedKeys(r.files),
+			Trees: sortedKeys(r.trees),
+			Full: r.full,
+		}
+	}
+
+	for _, id := range n.partners() {
+		if peer, ok := n.peerTable[id]; ok {
+			state.Partners[id] = peer.address
+		}
+	}
+
+	dat, err = json.Marshal(&state)
+
+	return err, dat
+}
+
+func (n *Node) writeState(dat []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(n.statePath), ".state-*")
+	if err != nil {
+		fmt.Printf("Error writing state: %s\n", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(dat); err != nil {
+		tmp.Close()
+		fmt.Printf("Error writing state: %s\n", err)
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		fmt.Printf("Error writing state: %s\n", err)
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		fmt.Printf("Error writing state: %s\n", err)
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), n.statePath); err != nil {
+		fmt.Printf("Error writing state: %s\n", err)
+		return err
+	}
+
+	return nil
+}
+
+// loadState restores a state saved by saveState, a missing file leaves the fresh node as it is
+func (n *Node) loadState() error {
+	if n.statePath == "" {
+		return nil
+	}
+
+	dat, err := os.ReadFile(n.statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Error reading state: %w", err)
+	}
+
+	var state nodeState
+	if err := json.Unmarshal(dat, &state); err != nil {
+		return fmt.Errorf("Error parsing state %s: %w", n.statePath, err)
+	}
+
+	if state.ID == "" {
+		return fmt.Errorf("State %s has no node id", n.statePath)
+	}
+
+	n.id = state.ID
+	// failovers and step downs change the role, the saved one wins over the flag
+	if state.IsPrimary != nil && *state.IsPrimary != n.isPrimary {
+		fmt.Printf("%s last ran with primary=%t, ignoring primary=%t\n", n.id, *state.IsPrimary, n.isPrimary)
+		n.isPrimary = *state.IsPrimary
+	}
+	n.lineage = state.Lineage
+	n.term = state.Term
+	if n.lineage == "" {
+		n.lineage = n.id
+	}
+	n.fileBudget = state.FileBudget
+
+	for hash, status := range state.Files {
+		n.fileStatusTable[hash] = status
+	}
+	for hash, codec := range state.FileCodecs {
+		n.fileCodecs[hash] = codec
+	}
+	for hash, owner := range state.FileOwners {
+		n.fileOwners[hash] = owner
+	}
+
+	for root, indexMap := range state.Trees {
+		err, t := treeFromIndexMap(indexMap)
+		if err != nil || t.root.hash != root {
+			return fmt.Errorf("State %s holds a broken tree %s", n.statePath, root)
+		}
+
+		n.trees[root] = t
+		n.treesStatus[root] = state.TreesStatus[root]
+	}
+
+	for hash, placement := range state.Shards {
+		n.shardPlacements[hash] = placement
+	}
+
+	for requester, count := range state.Bookings {
+		n.fileBookings[requester] = count
+		n.bookingCompression[requester] = state.BookingCodecs[requester]
+	}
+
+	// partners get the full death threshold to show up again
+	for id, address := range state.Partners {
+		n.peerTable[id] = newPeer(address)
+	}
+
+	if n.isPrimary {
+		for id, persisted := range state.Replicas {
+			// a replica nobody can reach is as good as dead
+			if _, ok := n.peerTable[id]; !ok {
+				continue
+			}
+
+			r := newReplicaState()
+			for _, hash := range persisted.Files {
+				r.files[hash] = struct{}{}
+			}
+			for _, root := range persisted.Trees {
+				r.trees[root] = struct{}{}
+			}
+			r.full = persisted.Full
+
+			n.replicas[id] = r
+		}
+		n.maritalStatus = len(n.replicas) > 0
+	} else if state.MarriedTo != "" {
+		n.marriedTo = state.MarriedTo
+		n.proposalID = state.ProposalID
+		n.maritalStatus = true
+	}
+
+	fmt.Printf("Restored state of %s: %d files, %d trees, %d replicas\n", n.id, len(n.fileStatusTable), len(n.trees), len(n.replicas))
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// restart brings up a fresh node from config, the way a restarted process would
+func restart(t *testing.T, config *Config) *Node {
+	t.Helper()
+
+	n := new(Node)
+	if err := n.init("127.0.0.1:0", config); err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+func stateConfig(t *testing.T, primary bool) *Config {
+	config := defaultConfig()
+	config.Primary = primary
+	config.StorageBackend = "memory"
+	config.DiscoveryMulticast = false
+	config.StateFile = filepath.Join(t.TempDir(), "state.json")
+
+	return config
+}
+
+func TestSavedRoleWinsOverTheFlag(t *testing.T) {
+	config := stateConfig(t, false)
+
+	// a replica promoted after its primary died
+	n := restart(t, config)
+	n.lock.Lock()
+	n.isPrimary = true
+	n.lock.Unlock()
+	if err := n.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := restart(t, config)
+	if restarted.id != n.id || !restarted.isPrimary {
+		t.Fatalf("restarted as %s with primary=%t, want %s as primary", restarted.id, restarted.isPrimary, n.id)
+	}
+
+	// and a primary that stepped down and married its successor
+	restarted.lock.Lock()
+	restarted.isPrimary = false
+	restarted.maritalStatus = true
+	restarted.marriedTo = "successor"
+	restarted.proposalID = "proposal"
+	restarted.lock.Unlock()
+	if err := restarted.saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	config.Primary = true
+	again := restart(t, config)
+	if again.isPrimary || again.marriedTo != "successor" || again.proposalID != "proposal" {
+		t.Fatalf("restarted with primary=%t married to %q by %q", again.isPrimary, again.marriedTo, again.proposalID)
+	}
+}
+
+func TestStateWithoutRoleKeepsTheFlag(t *testing.T) {
+	config := stateConfig(t, true)
+
+	if err := os.WriteFile(config.StateFile, []byte(`{"id":"abcd","file_budget":10}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	n := restart(t, config)
+	if n.id != "abcd" || !n.isPrimary {
+		t.Fatalf("restarted as %s with primary=%t, want abcd as primary", n.id, n.isPrimary)
+	}
+}
+
+func TestBookingsSurviveARestart(t *testing.T) {
+	config := stateConfig(t, false)
+	config.Budget = 10
+
+	n := restart(t, config)
+	var booking UploadRequestReply
+	if err := n.UploadRequest(&UploadRequestArgs{RequesterID: "primary", RequiredBudget: 3, Compression: CompressionGzip}, &booking); err != nil || !booking.Granted {
+		t.Fatalf("booking failed: %v", err)
+	}
+
+	restarted := restart(t, config)
+	if restarted.fileBookings["primary"] != 3 || restarted.bookingCompression["primary"] != CompressionGzip || restarted.fileBudget != 7 {
+		t.Fatalf("restarted with booking %d in %q and budget %d", restarted.fileBookings["primary"], restarted.bookingCompression["primary"], restarted.fileBudget)
+	}
+
+	// the booking is still good for an upload
+	content := "booked before the restart"
+	hash := ComputeHash(content)
+	var uploaded UploadFilesReply
+	if err := restarted.UploadFiles(&UploadFilesArgs{RequesterID: "primary", Files: map[string]string{hash: content}, Compression: CompressionNone}, &uploaded); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBatchedSavesCoverEveryCaller(t *testing.T) {
+	n := restart(t, stateConfig(t, true))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.saveState(); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n.stateWritten.Load() != 50 {
+		t.Fatalf("%d of 50 saves are on disk", n.stateWritten.Load())
+	}
+}
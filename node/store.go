@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+var ErrBlobNotFound = errors.New("blob not found")
+var ErrInvalidHash = errors.New("invalid blob hash")
+
+type BlobInfo struct {
+	Hash string
+	Size int64
+	ModTime time.Time
+}
+
+// BlobStore keeps file contents addressed by their hash. Implementations must
+// be safe for concurrent use and must never expose a partially written blob.
+type BlobStore interface {
+	Put(hash string, content []byte) error
+	// Get returns ErrBlobNotFound (wrapped) for unknown hashes
+	Get(hash string) (err error, content []byte)
+	Has(hash string) (err error, ok bool)
+	// Delete of an unknown hash is not an error
+	Delete(hash string) error
+	Stat(hash string) (err error, info BlobInfo)
+	List() (err error, hashes []string)
+}
+
+// newBlobStore builds the backend selected by config for the node with the given id
+func newBlobStore(config *Config, id string) (err error, store BlobStore) {
+	switch config.StorageBackend {
+		case "local":
+			return newLocalBlobStore(filepath.Join(config.StoragePath, id), config.StorageShardDepth, config.StorageFsync)
+		case "s3":
+			return newS3BlobStore(config.S3, id, config.TransferTimeout)
+		case "memory":
+			return nil, newMemoryBlobStore()
+		default:
+			return fmt.Errorf("unknown storage backend %q", config.StorageBackend), nil
+	}
+}
+
+// hashes end up in paths and object keys, only lowercase hex is accepted
+func validateHash(hash string) error {
+	if len(hash) == 0 {
+		return ErrInvalidHash
+	}
+
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9') && !(c >= 'a' && c <= 'f') {
+			return fmt.Errorf("%w: %q", ErrInvalidHash, hash)
+		}
+	}
+
+	return nil
+}
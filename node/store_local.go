@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prefix of blobs that are still being written, never listed or served
+const tempBlobPrefix = ".tmp-"
+
+// localBlobStore keeps every blob in its own file below root, sharded into
+// shardDepth levels of two hex characters (root/ab/cd/abcd...) so a single
+// directory never holds millions of entries.
+type localBlobStore struct {
+	root string
+	shardDepth int
+	fsync bool
+}
+
+func newLocalBlobStore(root string, shardDepth int, fsync bool) (err error, store *localBlobStore) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return fmt.Errorf("Error creating storage directory %s: %w", root, err), nil
+	}
+
+	return nil, &localBlobStore{root: root, shardDepth: shardDepth, fsync: fsync}
+}
+
+func (s *localBlobStore) path(hash string) (err error, path string) {
+	if err := validateHash(hash); err != nil {
+		return err, ""
+	}
+
+	if len(hash) < 2*s.shardDepth {
+		return fmt.Errorf("%w: %q is too short for %d shard levels", ErrInvalidHash, hash, s.shardDepth), ""
+	}
+
+	parts := []string{s.root}
+	for i := 0; i < s.shardDepth; i++ {
+		parts = append(parts, hash[2*i:2*i+2])
+	}
+
+	return nil, filepath.Join(append(parts, hash)...)
+}
+
+// Put writes to a temp file next to the destination and renames it into place,
+// readers see either the old blob or the complete new one.
+func (s *localBlobStore) Put(hash string, content []byte) error {
+	err, path := s.path(hash)
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Error creating directory for %s: %w", hash, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, tempBlobPrefix + "*")
+	if err != nil {
+		return fmt.Errorf("Error creating temp file for %s: %w", hash, err)
+	}
+	// a no-op once the rename went through
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing %s: %w", hash, err)
+	}
+
+	if s.fsync {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return fmt.Errorf("Error syncing %s: %w", hash, err)
+		}
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error closing %s: %w", hash, err)
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("Error setting permissions of %s: %w", hash, err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Error moving %s into place: %w", hash, err)
+	}
+
+	if s.fsync {
+		// persist the directory entry of the rename as well
+		return syncDir(dir)
+	}
+
+	return nil
+}
+
+func (s *localBlobStore) Get(hash string) (err error, content []byte) {
+	err, path := s.path(hash)
+	if err != nil {
+		return err, nil
+	}
+
+	content, err = os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, hash), nil
+	} else if err != nil {
+		return fmt.Errorf("Error reading %s: %w", hash, err), nil
+	}
+
+	return nil, content
+}
+
+func (s *localBlobStore) Has(hash string) (err error, ok bool) {
+	err, _ = s.Stat(hash)
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, false
+	} else if err != nil {
+		return err, false
+	}
+
+	return nil, true
+}
+
+func (s *localBlobStore) Delete(hash string) error {
+	err, path := s.path(hash)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Error deleting %s: %w", hash, err)
+	}
+
+	return nil
+}
+
+func (s *localBlobStore) Stat(hash string) (err error, info BlobInfo) {
+	err, path := s.path(hash)
+	if err != nil {
+		return err, BlobInfo{}
+	}
+
+	fi, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, hash), BlobInfo{}
+	} else if err != nil {
+		return fmt.Errorf("Error reading %s: %w", hash, err), BlobInfo{}
+	}
+
+	return nil, BlobInfo{Hash: hash, Size: fi.Size(), ModTime: fi.ModTime()}
+}
+
+func (s *localBlobStore) List() (err error, hashes []string) {
+	err = filepath.WalkDir(s.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempBlobPrefix) {
+			return nil
+		}
+
+		hashes = append(hashes, d.Name())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Error listing %s: %w", s.root, err), nil
+	}
+
+	return nil, hashes
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// memoryBlobStore keeps blobs in memory only, meant for tests and throwaway nodes
+type memoryBlobStore struct {
+	mu sync.RWMutex
+	blobs map[string][]byte
+	modTimes map[string]time.Time
+}
+
+func newMemoryBlobStore() *memoryBlobStore {
+	return &memoryBlobStore{
+		blobs: make(map[string][]byte),
+		modTimes: make(map[string]time.Time),
+	}
+}
+
+func (s *memoryBlobStore) Put(hash string, content []byte) error {
+	if err := validateHash(hash); err != nil {
+		return err
+	}
+
+	// callers may reuse their buffer
+	stored := make([]byte, len(content))
+	copy(stored, content)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blobs[hash] = stored
+	s.modTimes[hash] = time.Now()
+
+	return nil
+}
+
+func (s *memoryBlobStore) Get(hash string) (err error, content []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.blobs[hash]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, hash), nil
+	}
+
+	content = make([]byte, len(stored))
+	copy(content, stored)
+
+	return nil, content
+}
+
+func (s *memoryBlobStore) Has(hash string) (err error, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok = s.blobs[hash]
+	return nil, ok
+}
+
+func (s *memoryBlobStore) Delete(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.blobs, hash)
+	delete(s.modTimes, hash)
+
+	return nil
+}
+
+func (s *memoryBlobStore) Stat(hash string) (err error, info BlobInfo) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.blobs[hash]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, hash), BlobInfo{}
+	}
+
+	return nil, BlobInfo{Hash: hash, Size: int64(len(stored)), ModTime: s.modTimes[hash]}
+}
+
+func (s *memoryBlobStore) List() (err error, hashes []string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for hash := range s.blobs {
+		hashes = append(hashes, hash)
+	}
+
+	return nil, hashes
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3BlobStore keeps every blob as an object <prefix>/<node id>/<hash> in a
+// bucket of any S3 compatible service (MinIO, AWS S3, ...). Object PUTs are
+// atomic on the service side, so no temp object dance is needed.
+type s3BlobStore struct {
+	client *minio.Client
+	bucket string
+	// key prefix of this node, always ends with '/'
+	prefix string
+	// deadline of every single request to the service
+	timeout time.Duration
+}
+
+func newS3BlobStore(config S3Config, id string, timeout time.Duration) (err error, store *s3BlobStore) {
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds: credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure: config.Secure,
+		Region: config.Region,
+	})
+	if err != nil {
+		return fmt.Errorf("Error creating S3 client for %s: %w", config.Endpoint, err), nil
+	}
+
+	store = &s3BlobStore{
+		client: client,
+		bucket: config.Bucket,
+		prefix: path.Join(config.Prefix, id) + "/",
+		timeout: timeout,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return fmt.Errorf("Error reaching bucket %s on %s: %w", config.Bucket, config.Endpoint, err), nil
+	}
+
+	if !exists {
+		if !config.CreateBucket {
+			return fmt.Errorf("Bucket %s does not exist on %s", config.Bucket, config.Endpoint), nil
+		}
+
+		if err := client.MakeBucket(ctx, config.Bucket, minio.MakeBucketOptions{Region: config.Region}); err != nil {
+			return fmt.Errorf("Error creating bucket %s: %w", config.Bucket, err), nil
+		}
+	}
+
+	return nil, store
+}
+
+func (s *s3BlobStore) key(hash string) (err error, key string) {
+	if err := validateHash(hash); err != nil {
+		return err, ""
+	}
+
+	return nil, s.prefix + hash
+}
+
+func (s *s3BlobStore) Put(hash string, content []byte) error {
+	err, key := s.key(hash)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err = s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(content), int64(len(content)), minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return fmt.Errorf("Error writing %s: %w", hash, err)
+	}
+
+	return nil
+}
+
+func (s *s3BlobStore) Get(hash string) (err error, content []byte) {
+	err, key := s.key(hash)
+	if err != nil {
+		return err, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	object, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return s.objectError(hash, err), nil
+	}
+	defer object.Close()
+
+	// GetObject is lazy, a missing key only shows up on the first read
+	content, err = io.ReadAll(object)
+	if err != nil {
+		return s.objectError(hash, err), nil
+	}
+
+	return nil, content
+}
+
+func (s *s3BlobStore) Has(hash string) (err error, ok bool) {
+	err, _ = s.Stat(hash)
+	if err == nil {
+		return nil, true
+	}
+
+	if errors.Is(err, ErrBlobNotFound) {
+		return nil, false
+	}
+
+	return err, false
+}
+
+func (s *s3BlobStore) Delete(hash string) error {
+	err, key := s.key(hash)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	// deleting a missing key succeeds on S3
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("Error deleting %s: %w", hash, err)
+	}
+
+	return nil
+}
+
+func (s *s3BlobStore) Stat(hash string) (err error, info BlobInfo) {
+	err, key := s.key(hash)
+	if err != nil {
+		return err, BlobInfo{}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	object, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		return s.objectError(hash, err), BlobInfo{}
+	}
+
+	return nil, BlobInfo{Hash: hash, Size: object.Size, ModTime: object.LastModified}
+}
+
+func (s *s3BlobStore) List() (err error, hashes []string) {
+	// listing may page through many requests, the timeout covers the whole listing
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	for object := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix, Recursive: true}) {
+		if object.Err != nil {
+			return fmt.Errorf("Error listing %s: %w", s.prefix, object.Err), nil
+		}
+
+		hashes = append(hashes, strings.TrimPrefix(object.Key, s.prefix))
+	}
+
+	return nil, hashes
+}
+
+func (s *s3BlobStore) objectError(hash string, err error) error {
+	if isNotFound(err) {
+		return fmt.Errorf("%w: %s", ErrBlobNotFound, hash)
+	}
+
+	return fmt.Errorf("Error reading %s: %w", hash, err)
+}
+
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBlobStore runs the BlobStore contract against a fresh, empty store
+func testBlobStore(t *testing.T, store BlobStore) {
+	content := []byte("hello blob")
+	hash := ComputeHash(string(content))
+
+	t.Run("missing", func(t *testing.T) {
+		if err, _ := store.Get(hash); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Get of a missing blob returned %v, want ErrBlobNotFound", err)
+		}
+		if err, ok := store.Has(hash); err != nil || ok {
+			t.Fatalf("Has of a missing blob returned %v, %v", ok, err)
+		}
+		if err, _ := store.Stat(hash); !errors.Is(err, ErrBlobNotFound) {
+			t.Fatalf("Stat of a missing blob returned %v, want ErrBlobNotFound", err)
+		}
+		if err := store.Delete(hash); err != nil {
+			t.Fatalf("Delete of a missing blob returned %v", err)
+		}
+	})
+
+	t.Run("invalid hash", func(t *testing.T) {
+		for _, bad := range []string{"", "../escape", "ABCDEF", "a/b"} {
+			if err := store.Put(bad, content); !errors.Is(err, ErrInvalidHash) {
+				t.Fatalf("Put of %q returned %v, want ErrInvalidHash", bad, err)
+			}
+		}
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		if err := store.Put(hash, content); err != nil {
+			t.Fatal(err)
+		}
+		// content addressed, storing the same blob again is harmless
+		if err := store.Put(hash, content); err != nil {
+			t.Fatal(err)
+		}
+
+		err, got := store.Get(hash)
+		if err != nil || !bytes.Equal(got, content) {
+			t.Fatalf("Get returned %q, %v", got, err)
+		}
+		if err, ok := store.Has(hash); err != nil || !ok {
+			t.Fatalf("Has returned %v, %v", ok, err)
+		}
+
+		err, info := store.Stat(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Hash != hash || info.Size != int64(len(content)) {
+			t.Fatalf("Stat returned %+v", info)
+		}
+
+		err, hashes := store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(hashes) != 1 || hashes[0] != hash {
+			t.Fatalf("List returned %v, want [%s]", hashes, hash)
+		}
+
+		if err := store.Delete(hash); err != nil {
+			t.Fatal(err)
+		}
+		if err, ok := store.Has(hash); err != nil || ok {
+			t.Fatalf("Has after Delete returned %v, %v", ok, err)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		want := make([]string, 16)
+		for i := range want {
+			content := fmt.Sprintf("blob %d", i)
+			want[i] = ComputeHash(content)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				if err := store.Put(want[i], []byte(content)); err != nil {
+					t.Error(err)
+					return
+				}
+				if err, got := store.Get(want[i]); err != nil || string(got) != content {
+					t.Errorf("Get returned %q, %v", got, err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		err, hashes := store.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(want)
+		sort.Strings(hashes)
+		if fmt.Sprint(hashes) != fmt.Sprint(want) {
+			t.Fatalf("List returned %v, want %v", hashes, want)
+		}
+
+		for _, hash := range want {
+			if err := store.Delete(hash); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestMemoryBlobStore(t *testing.T) {
+	testBlobStore(t, newMemoryBlobStore())
+}
+
+func TestLocalBlobStore(t *testing.T) {
+	err, store := newLocalBlobStore(t.TempDir(), 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBlobStore(t, store)
+}
+
+// TestS3BlobStore needs a reachable service, e.g.
+// TWOGUD_TEST_S3_ENDPOINT=localhost:9000 for a MinIO with the default credentials
+func TestS3BlobStore(t *testing.T) {
+	endpoint := os.Getenv("TWOGUD_TEST_S3_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("TWOGUD_TEST_S3_ENDPOINT is not set")
+	}
+
+	config := S3Config{
+		Endpoint: endpoint,
+		Bucket: "2gud-test",
+		Prefix: "conformance",
+		AccessKey: "minioadmin",
+		SecretKey: "minioadmin",
+		CreateBucket: true,
+	}
+	if bucket := os.Getenv("TWOGUD_TEST_S3_BUCKET"); bucket != "" {
+		config.Bucket = bucket
+	}
+	if key := os.Getenv("TWOGUD_TEST_S3_ACCESS_KEY"); key != "" {
+		config.AccessKey = key
+		config.SecretKey = os.Getenv("TWOGUD_TEST_S3_SECRET_KEY")
+	}
+	config.Secure = os.Getenv("TWOGUD_TEST_S3_SECURE") == "true"
+
+	// a prefix of its own per run keeps the store empty
+	err, store := newS3BlobStore(config, fmt.Sprint(time.Now().UnixNano()), 10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testBlobStore(t, store)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// tlsConfig is used by call for every outbound connection, nil means plaintext.
+// Peers present the node certificate when dialling so a listener running
+// with mutual TLS can verify them.
+var tlsConfig *tls.Config
+
+// loadTLSConfig builds the listener and dialer configs from PEM files.
+// caFile is the CA that signs every node (and client) certificate of the cluster,
+// requireClientCert turns on mutual TLS for every incoming connection.
+func loadTLSConfig(certFile string, keyFile string, caFile string, requireClientCert bool) (err error, server *tls.Config, client *tls.Config) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading node certificate: %w", err), nil, nil
+	}
+
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return err, nil, nil
+	}
+
+	server = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs: pool,
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if requireClientCert {
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	client = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs: pool,
+		MinVersion: tls.VersionTLS12,
+	}
+
+	return nil, server, client
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA certificate: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("No certificates found in " + caFile)
+	}
+
+	return pool, nil
+}
@@ -91,6 +91,32 @@ func (t *MerkleTree) AddLeaf(hash string) error {
 	return nil
 }
 
+// treeFromIndexMap rebuilds a tree from the leaf positions of its hashToIndex
+func treeFromIndexMap(indexMap map[string]int) (err error, t *MerkleTree) {
+	if len(indexMap) == 0 {
+		return errors.New("Tree has no leaves"), nil
+	}
+
+	orderedHashes := make([]string, len(indexMap))
+	for hash, index := range indexMap {
+		if index < 0 || index >= len(indexMap) || orderedHashes[index] != "" {
+			return errors.New("Leaf indices are not contiguous"), nil
+		}
+		orderedHashes[index] = hash
+	}
+
+	t = &MerkleTree{}
+	for i, mh := range orderedHashes {
+		if i == 0 {
+			t.Init(mh)
+		} else if err := t.AddLeaf(mh); err != nil {
+			return err, nil
+		}
+	}
+
+	return nil, t
+}
+
 func (t *MerkleTree) Depth() int {
 	return int(math.Ceil(math.Log2(float64(t.root.weight))))
 }
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"crypto/sha256"
-	"os"
 	"net/rpc"
 	"net"
+	"strings"
+	"time"
 )
 
 func ComputeHash(content string) string {
@@ -17,64 +23,147 @@ func ComputeHash(content string) string {
   	return fmt.Sprintf("%x", h.Sum(nil))
 }
 
-func storeFile(node_id string, hash string, content string) error {
-	// Create the uploads folder if it doesn't already exist
-	err := os.MkdirAll(fmt.Sprintf("./%s", node_id), os.ModePerm)
+// port assumed for addresses that don't carry one
+const defaultPort = "8080"
+
+// ErrTimeout is returned (wrapped) by call whenever the peer did not answer
+// before the context deadline, so callers can tell a slow or hung peer apart
+// from one that actively refused the request.
+var ErrTimeout = errors.New("RPC call timed out")
+
+// send an RPC request to a peer and wait for the response.
+// the call is abandoned as soon as ctx is cancelled or its deadline passes,
+// a connection is never left blocking the caller.
+//
+func call(ctx context.Context, address string, rpcname string, args interface{}, reply interface{}) (e error) {
+	address = withDefaultPort(address)
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", address)
 	if err != nil {
-		return errors.New("Error creating directory for storing file")
+		return callError(ctx, address, rpcname, err)
+	}
+	defer conn.Close()
+
+	if tlsConfig != nil {
+		// node certificates carry their IPs as SANs
+		host, _, _ := net.SplitHostPort(address)
+		config := tlsConfig.Clone()
+		config.ServerName = host
+
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return callError(ctx, address, rpcname, err)
+		}
+		conn = tlsConn
 	}
 
-	// Create a new file in the uploads directory
-	err = os.WriteFile(fmt.Sprintf("./%s/%s", node_id, hash), []byte(content), 0644)
+	// reads and writes on the raw connection must not outlive the context either
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	// same handshake as rpc.DialHTTP, which has no context aware variant
+	io.WriteString(conn, "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
 	if err != nil {
-		return errors.New("Error writing to file")
+		return callError(ctx, address, rpcname, err)
+	}
+	if resp.Status != "200 Connected to Go RPC" {
+		return errors.New("unexpected HTTP response: " + resp.Status)
+	}
+
+	c := rpc.NewClient(conn)
+	defer c.Close()
+
+	pending := c.Go(rpcname, args, reply, make(chan *rpc.Call, 1))
+	select {
+		case <-ctx.Done():
+			return callError(ctx, address, rpcname, ctx.Err())
+		case res := <-pending.Done:
+			if res.Error != nil {
+				return callError(ctx, address, rpcname, res.Error)
+			}
 	}
 
 	return nil
 }
 
-func readFile(node_id string, hash string) (err error, content string) {
-	dat, err := os.ReadFile(node_id + "/" + hash)
-	if err != nil {
-		return errors.New("Error reading th file"), ""
+// withDefaultPort appends defaultPort to a bare IPv4, IPv6 or host name
+func withDefaultPort(address string) string {
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
 	}
-	content = string(dat)
 
-	return nil, content
+	return net.JoinHostPort(strings.Trim(address, "[]"), defaultPort)
 }
 
-// send an RPC request to the coordinator, wait for the response.
-// usually returns true.
-// returns false if something goes wrong.
-//
-func call(ip string, rpcname string, args interface{}, reply interface{}) (e error) {
-	c, err := rpc.DialHTTP("tcp", ip + ":8080")
-	if err != nil {
-		return err
+func callError(ctx context.Context, address string, rpcname string, err error) error {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %s on %s", ErrTimeout, rpcname, address)
 	}
-	defer c.Close()
 
-	err = c.Call(rpcname, args, reply)
-	if err == nil {
-		return nil
+	if errors.Is(ctx.Err(), context.Canceled) {
+		return fmt.Errorf("%s on %s cancelled: %w", rpcname, address, ctx.Err())
 	}
 
 	return err
 }
 
 // source: https://stackoverflow.com/a/31551220
+// prefers IPv4, falls back to a global IPv6 address on IPv6-only hosts
 func GetLocalIP() string {
     addrs, err := net.InterfaceAddrs()
     if err != nil {
         return ""
     }
+    ipv6 := ""
     for _, address := range addrs {
         // check the address type and if it is not a loopback the display it
         if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
             if ipnet.IP.To4() != nil {
                 return ipnet.IP.String()
             }
+            if ipv6 == "" && ipnet.IP.IsGlobalUnicast() {
+                ipv6 = ipnet.IP.String()
+            }
         }
     }
-    return ""
-}
\ No newline at end of file
+    return ipv6
+}
+
+// supervise runs fn until ctx is cancelled, restarting it with exponential
+// backoff whenever it panics or returns early
+func supervise(ctx context.Context, name string, fn func(ctx context.Context)) {
+	backoff := time.Second
+
+	for {
+		started := time.Now()
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					fmt.Printf("%s crashed: %v\n", name, r)
+				}
+			}()
+			fn(ctx)
+		}()
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		// a run that lasted a while starts the backoff over
+		if time.Since(started) > time.Minute {
+			backoff = time.Second
+		}
+
+		fmt.Printf("Restarting %s in %s\n", name, backoff)
+		select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+		}
+		backoff = min(2 * backoff, time.Minute)
+	}
+}